@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/metrics"
+	"github.com/knadh/niltalk/store"
+)
+
+type adminCfg struct {
+	Address string `koanf:"address"`
+	Metrics bool   `koanf:"metrics"`
+	// Bearer token of the admin API. The API is disabled without one.
+	Token string `koanf:"token"`
+}
+
+type reqNotice struct {
+	Message string `json:"message"`
+}
+
+type reqPredefinedRoom struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Password string              `json:"password"`
+	Motd     string              `json:"motd"`
+	Admins   []string            `json:"admins"`
+	Users    []reqPredefinedUser `json:"users"`
+}
+
+type reqPredefinedUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+var (
+	metricStoreOps = metrics.Default.NewHistogram("niltalk_store_operation_seconds",
+		"Duration of the store operations.",
+		[]float64{.0005, .001, .005, .01, .05, .1, .5, 1}, "backend", "op")
+	metricStoreErrors = metrics.Default.NewCounter("niltalk_store_errors_total",
+		"Store operations that failed.", "backend", "op")
+)
+
+// observeStore reports the operations of the store to the metrics.
+func observeStore(s store.Store, backend string) store.Store {
+	return store.Observe(s, func(op string, d time.Duration, err error) {
+		metricStoreOps.Observe(d.Seconds(), backend, op)
+		if err != nil && err != store.ErrRoomNotFound {
+			metricStoreErrors.Inc(backend, op)
+		}
+	})
+}
+
+// startAdmin starts the admin listener, separate from the public one.
+func startAdmin(cfg adminCfg, r http.Handler) *http.Server {
+	logger.Printf("starting admin server on http://%v", cfg.Address)
+	srv := &http.Server{Addr: cfg.Address, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("couldn't serve admin: %v", err)
+		}
+	}()
+	return srv
+}
+
+// adminRouter returns the routes of the admin listener.
+func adminRouter(cfg adminCfg, app *App) http.Handler {
+	r := chi.NewRouter()
+	if cfg.Metrics {
+		r.Get("/metrics", metrics.Default.ServeHTTP)
+	}
+
+	if cfg.Token == "" {
+		logger.Printf("admin.token is not set, the admin API is disabled")
+		return r
+	}
+	r.Route("/api", func(r chi.Router) {
+		r.Use(adminAuth(cfg.Token))
+		r.Get("/rooms", wrap(handleAdminGetRooms, app, 0))
+		r.Post("/rooms", wrap(handleAdminCreateRoom, app, 0))
+		r.Delete("/rooms/{roomID}", wrap(handleAdminDisposeRoom, app, 0))
+		r.Get("/rooms/{roomID}/peers", wrap(handleAdminGetPeers, app, 0))
+		r.Delete("/rooms/{roomID}/sessions/{sessID}", wrap(handleAdminKickSession, app, 0))
+		r.Delete("/rooms/{roomID}/tokens/{handle}", wrap(handleAdminRevokeTokens, app, 0))
+		r.Post("/rooms/{roomID}/notice", wrap(handleAdminNotice, app, 0))
+		r.Post("/notice", wrap(handleAdminNotice, app, 0))
+	})
+	return r
+}
+
+// adminAuth is a middleware that checks the bearer token of admin requests.
+func adminAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+				respondJSON(w, nil, errors.New("invalid token"), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleAdminGetRooms lists the active rooms.
+func handleAdminGetRooms(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("ctx").(*reqCtx).app
+	respondJSON(w, app.hub.RoomsInfo(), nil, http.StatusOK)
+}
+
+// handleAdminGetPeers lists the peers of an active room.
+func handleAdminGetPeers(w http.ResponseWriter, r *http.Request) {
+	var (
+		app  = r.Context().Value("ctx").(*reqCtx).app
+		room = app.hub.GetRoom(chi.URLParam(r, "roomID"))
+	)
+	if room == nil {
+		respondJSON(w, nil, hub.ErrRoomNotFound, http.StatusNotFound)
+		return
+	}
+	respondJSON(w, room.PeersInfo(), nil, http.StatusOK)
+}
+
+// handleAdminDisposeRoom disposes of a room, predefined or not.
+func handleAdminDisposeRoom(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("ctx").(*reqCtx).app
+	err := app.hub.DisposeRoom(chi.URLParam(r, "roomID"))
+	if err == hub.ErrRoomNotFound {
+		respondJSON(w, nil, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondJSON(w, nil, errors.New("error disposing of room"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminKickSession removes a session of an active room and disconnects
+// its peer.
+func handleAdminKickSession(w http.ResponseWriter, r *http.Request) {
+	var (
+		app  = r.Context().Value("ctx").(*reqCtx).app
+		room = app.hub.GetRoom(chi.URLParam(r, "roomID"))
+	)
+	if room == nil {
+		respondJSON(w, nil, hub.ErrRoomNotFound, http.StatusNotFound)
+		return
+	}
+	if err := room.KickSession(chi.URLParam(r, "sessID")); err != nil {
+		respondJSON(w, nil, errors.New("error removing session"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminRevokeTokens revokes the autologin tokens sent to a predefined
+// user of an active room.
+func handleAdminRevokeTokens(w http.ResponseWriter, r *http.Request) {
+	var (
+		app  = r.Context().Value("ctx").(*reqCtx).app
+		room = app.hub.GetRoom(chi.URLParam(r, "roomID"))
+	)
+	if room == nil {
+		respondJSON(w, nil, hub.ErrRoomNotFound, http.StatusNotFound)
+		return
+	}
+	if err := room.RevokeTokens(chi.URLParam(r, "handle")); err != nil {
+		respondJSON(w, nil, errors.New("error revoking tokens"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminNotice broadcasts a notice to a room, or to all active rooms.
+func handleAdminNotice(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("ctx").(*reqCtx).app
+
+	var req reqNotice
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		respondJSON(w, nil, errors.New("empty message"), http.StatusBadRequest)
+		return
+	}
+
+	roomID := chi.URLParam(r, "roomID")
+	if roomID == "" {
+		app.hub.Notice(req.Message)
+		respondJSON(w, true, nil, http.StatusOK)
+		return
+	}
+
+	room := app.hub.GetRoom(roomID)
+	if room == nil {
+		respondJSON(w, nil, hub.ErrRoomNotFound, http.StatusNotFound)
+		return
+	}
+	room.Notice(req.Message)
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminCreateRoom creates a predefined room, until the next restart.
+func handleAdminCreateRoom(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("ctx").(*reqCtx).app
+
+	var req reqPredefinedRoom
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" || len(req.ID) > 100 || strings.ContainsAny(req.ID, "/?#% ") {
+		respondJSON(w, nil, errors.New("invalid room ID"), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := app.hub.Store.RoomExists(req.ID)
+	if err != nil {
+		respondJSON(w, nil, errors.New("error checking room ID"), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		respondJSON(w, nil, hub.ErrRoomExists, http.StatusConflict)
+		return
+	}
+
+	room := hub.PredefinedRoom{
+		ID:       req.ID,
+		Name:     req.Name,
+		Password: req.Password,
+		Motd:     req.Motd,
+		Admins:   req.Admins,
+	}
+	for _, u := range req.Users {
+		pwd := u.Password
+		if pwd != "" && !hub.IsPasswordHash(pwd) {
+			if pwd, err = hub.HashPassword(pwd); err != nil {
+				respondJSON(w, nil, errors.New("error hashing password"), http.StatusInternalServerError)
+				return
+			}
+		}
+		room.Users = append(room.Users, hub.PredefinedUser{Name: u.Name, Password: pwd})
+	}
+	if err := app.hub.DefineRoom(room); err != nil {
+		respondJSON(w, nil, err, http.StatusConflict)
+		return
+	}
+	if err := app.addPredefinedRoom(room, app.themesBox); err != nil {
+		app.hub.DisposeRoom(room.ID)
+		respondJSON(w, nil, errors.New("error creating room"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +30,7 @@ const (
 type sess struct {
 	ID     string
 	Handle string
+	Role   string
 }
 
 // reqCtx is the context injected into every request.
@@ -56,6 +58,9 @@ type reqRoom struct {
 	Handle   string `json:"handle"`
 	Password string `json:"password"`
 	UserPwd  string `json:"userpwd"`
+
+	// The room is end-to-end encrypted.
+	Encrypted bool `json:"encrypted"`
 }
 
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
@@ -69,7 +74,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		app = ctx.app
 	)
 	respondHTML("index", tplData{
-		Title: app.cfg.Name,
+		Title: app.hub.Config().Name,
 	}, http.StatusOK, w, app)
 }
 
@@ -88,9 +93,9 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 
 	al := r.URL.Query().Get("al")
 	if al != "" {
-		sessID, err := room.LoginWithToken(al, app.cfg.RoomAge)
+		sessID, err := room.LoginWithToken(al, app.hub.Config().RoomAge)
 		if err == nil {
-			ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: fmt.Sprintf("/r/%v", room.ID)}
+			ck := &http.Cookie{Name: app.hub.Config().SessionCookie, Value: sessID, Path: fmt.Sprintf("/r/%v", room.ID)}
 			http.SetCookie(w, ck)
 			http.Redirect(w, r, r.URL.String(), http.StatusTemporaryRedirect)
 			return
@@ -141,17 +146,29 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		req.Handle = h
 	}
 
-	sessID, err := room.Login(req.Password, req.Handle, req.UserPwd, app.cfg.RoomAge)
+	// The creator of the room holds its owner key.
+	var ownerKey string
+	if ck, _ := r.Cookie(app.hub.Config().SessionCookie + "_owner"); ck != nil {
+		ownerKey = ck.Value
+	}
+
+	sessID, err := room.Login(req.Password, req.Handle, req.UserPwd, ownerKey, app.hub.Config().RoomAge)
 	if err == hub.ErrInvalidRoomPassword || err == hub.ErrInvalidUserPassword {
 		respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
 		return
+	} else if err == hub.ErrBanned {
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
+	} else if err == hub.ErrShuttingDown {
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
 	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
 	// Set the session cookie.
-	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: fmt.Sprintf("/r/%v", room.ID)}
+	ck := &http.Cookie{Name: app.hub.Config().SessionCookie, Value: sessID, Path: fmt.Sprintf("/r/%v", room.ID)}
 	http.SetCookie(w, ck)
 	respondJSON(w, true, nil, http.StatusOK)
 }
@@ -176,7 +193,7 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete the session cookie.
-	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: "", MaxAge: -1, Path: fmt.Sprintf("/r/%v", room.ID)}
+	ck := &http.Cookie{Name: app.hub.Config().SessionCookie, Value: "", MaxAge: -1, Path: fmt.Sprintf("/r/%v", room.ID)}
 	http.SetCookie(w, ck)
 	respondJSON(w, true, nil, http.StatusOK)
 }
@@ -194,6 +211,16 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A reconnecting peer only gets the payloads after the last one it got.
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
+	// The public key the peer announces to the others in an encrypted room.
+	key := r.URL.Query().Get("key")
+	if room.Encrypted && !hub.ValidPeerKey(key) {
+		respondJSON(w, nil, errors.New("invalid peer key"), http.StatusBadRequest)
+		return
+	}
+
 	// Create the WS connection.
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -202,7 +229,7 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a new peer instance and add to the room.
-	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, ws)
+	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, ctx.sess.Role, key, since, ws)
 }
 
 // respondJSON responds to an HTTP request with a generic payload or an error.
@@ -246,7 +273,7 @@ func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWr
 		QRConfig qrConfig
 		Data     tplData
 	}{
-		Config:   app.cfg,
+		Config:   app.hub.Config(),
 		QRConfig: app.qrConfig,
 		Data:     data,
 	})
@@ -280,12 +307,20 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create and activate the new room.
-	room, err := app.hub.AddRoom(req.Name, req.Password)
-	if err != nil {
+	room, ownerKey, err := app.hub.AddRoom(req.Name, req.Password, req.Encrypted)
+	if err == hub.ErrMaxRooms || err == hub.ErrShuttingDown {
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
+	// Set the owner key cookie that makes the creator an owner on login.
+	ck := &http.Cookie{Name: app.hub.Config().SessionCookie + "_owner", Value: ownerKey,
+		Path: fmt.Sprintf("/r/%v", room.ID), HttpOnly: true}
+	http.SetCookie(w, ck)
+
 	respondJSON(w, struct {
 		ID string `json:"id"`
 	}{room.ID}, nil, http.StatusOK)
@@ -302,7 +337,7 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 
 		// Check if the request is authenticated.
 		if opts&hasAuth != 0 {
-			ck, _ := r.Cookie(app.cfg.SessionCookie)
+			ck, _ := r.Cookie(app.hub.Config().SessionCookie)
 			if ck != nil && ck.Value != "" {
 				s, err := app.hub.Store.GetSession(ck.Value, roomID)
 				if err != nil {
@@ -313,6 +348,7 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 				req.sess = sess{
 					ID:     s.ID,
 					Handle: s.Handle,
+					Role:   s.Role,
 				}
 			}
 		}
@@ -323,7 +359,10 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 			// handler. It's the handler's responsibility to throw an error,
 			// API or HTML response.
 			room, err := app.hub.ActivateRoom(roomID)
-			if err == nil {
+			if err == hub.ErrMaxRooms || err == hub.ErrShuttingDown {
+				respondJSON(w, nil, err, http.StatusServiceUnavailable)
+				return
+			} else if err == nil {
 				req.room = room
 			}
 		}
@@ -369,6 +408,12 @@ func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Reque
 	}()
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Uploaded files are stored in the clear.
+		if room := r.Context().Value("ctx").(*reqCtx).room; room != nil && room.Encrypted {
+			respondJSON(w, nil, errors.New("uploads are disabled in encrypted rooms"), http.StatusBadRequest)
+			return
+		}
+
 		err := r.ParseMultipartForm(store.MaxUploadSize)
 
 		if err == nil {
@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RoomInfo describes an active room to the operators.
+type RoomInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Predefined   bool      `json:"predefined"`
+	Peers        int       `json:"peers"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// PeerInfo describes a peer of a room to the operators.
+type PeerInfo struct {
+	ID     string `json:"id"`
+	Handle string `json:"handle"`
+	Role   string `json:"role"`
+	// The peer is connected to another instance in cluster mode.
+	Remote bool `json:"remote"`
+	// The peer lost its connection and may still reconnect.
+	Leaving bool `json:"leaving"`
+}
+
+// RoomsInfo returns the list of active rooms.
+func (h *Hub) RoomsInfo() []RoomInfo {
+	rooms := h.getRooms()
+	out := make([]RoomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		out = append(out, RoomInfo{
+			ID:           r.ID,
+			Name:         r.Name,
+			Predefined:   r.Predefined,
+			Peers:        int(atomic.LoadInt32(&r.numPeers)),
+			LastActivity: r.lastActive(),
+		})
+	}
+	return out
+}
+
+// PeersInfo returns the list of the room's peers.
+func (r *Room) PeersInfo() []PeerInfo {
+	var out []PeerInfo
+	r.do(func() {
+		for p := range r.peers {
+			out = append(out, PeerInfo{ID: p.ID, Handle: p.Handle, Role: p.Role})
+		}
+		for _, l := range r.leaving {
+			out = append(out, PeerInfo{ID: l.peer.ID, Handle: l.peer.Handle, Role: l.peer.Role, Leaving: true})
+		}
+		for _, p := range r.remotePeers {
+			out = append(out, PeerInfo{ID: p.ID, Handle: p.Handle, Role: p.Role, Remote: true})
+		}
+	})
+	return out
+}
+
+// KickSession removes a session from the room and disconnects its peer,
+// wherever it's connected.
+func (r *Room) KickSession(sessID string) error {
+	if err := r.hub.Store.RemoveSession(sessID, r.ID); err != nil {
+		r.hub.log.Printf("error removing session: %v", err)
+		return err
+	}
+	r.do(func() {
+		for p := range r.peers {
+			if p.ID == sessID {
+				r.kickPeer(p.Handle, TypePeerKicked)
+				return
+			}
+		}
+		if _, ok := r.leaving[sessID]; ok {
+			r.kickLeaving(sessID)
+			return
+		}
+		if p, ok := r.remotePeers[sessID]; ok {
+			r.publish(clusterEvent{Type: clusterModerate, ReqType: TypePeerKick, To: p.Handle})
+		}
+	})
+	return nil
+}
+
+// Notice broadcasts a notice from the operators to the room.
+func (r *Room) Notice(msg string) {
+	r.do(func() {
+		r.broadcast(r.makePayload(msg, TypeNotice), false)
+	})
+}
+
+// Notice broadcasts a notice from the operators to all the active rooms.
+func (h *Hub) Notice(msg string) {
+	for _, r := range h.getRooms() {
+		r.Notice(msg)
+	}
+}
+
+// DisposeRoom disposes of a room, active or not. Predefined rooms are removed
+// from the configuration until the next restart.
+func (h *Hub) DisposeRoom(id string) error {
+	h.updateConfig(func(cfg *Config) error {
+		for k, pr := range cfg.Rooms {
+			if pr.ID == id {
+				delete(cfg.Rooms, k)
+			}
+		}
+		return nil
+	})
+
+	r := h.GetRoom(id)
+	if r == nil {
+		ok, err := h.Store.RoomExists(id)
+		if err != nil {
+			h.log.Printf("error checking room in store: %v", err)
+			return err
+		}
+		if !ok {
+			return ErrRoomNotFound
+		}
+		h.Store.ClearSessions(id)
+		h.Store.ClearHistory(id)
+		return h.removeRoom(id)
+	}
+
+	r.do(func() { r.Predefined = false })
+	r.Dispose()
+	return nil
+}
+
+// DefineRoom adds a predefined room to the configuration, to be added with
+// AddPredefinedRoom.
+func (h *Hub) DefineRoom(pr PredefinedRoom) error {
+	return h.updateConfig(func(cfg *Config) error {
+		if _, ok := h.rooms[pr.ID]; ok {
+			return ErrRoomExists
+		}
+		for _, r := range cfg.Rooms {
+			if r.ID == pr.ID {
+				return ErrRoomExists
+			}
+		}
+		cfg.Rooms[pr.ID] = pr
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package hub
+
+import (
+	"encoding/json"
+)
+
+// Types of events exchanged between the instances serving a room.
+const (
+	clusterBroadcast = "broadcast"
+	clusterPeerJoin  = "peer.join"
+	clusterPeerLeave = "peer.leave"
+	clusterPeerSync  = "peer.sync"
+	clusterForward   = "forward"
+	clusterDispose   = "dispose"
+	clusterModerate  = "moderate"
+	clusterRole      = "role"
+	clusterEdit      = "edit"
+	clusterReaction  = "reaction"
+	clusterDelivery  = "delivery"
+	clusterRead      = "read"
+	clusterTopic     = "topic"
+	clusterPins      = "pins"
+	clusterHandle    = "handle"
+	clusterMention   = "mention"
+)
+
+// clusterEvent represents a room event published on the bus.
+type clusterEvent struct {
+	Node string `json:"node"`
+	Type string `json:"type"`
+
+	// Broadcast.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Record  bool            `json:"record,omitempty"`
+
+	// Peer join / leave.
+	Peer *payloadMsgPeer `json:"peer,omitempty"`
+
+	// Forward.
+	ReqType string      `json:"req_type,omitempty"`
+	To      string      `json:"to,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// subscribe subscribes the room to its bus topic and asks the other
+// instances to announce their peers.
+func (r *Room) subscribe() {
+	if r.hub.Bus == nil {
+		return
+	}
+
+	ch, unsub, err := r.hub.Bus.Subscribe(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error subscribing room %s to the bus: %v", r.ID, err)
+		return
+	}
+	r.clusterQ = ch
+	r.unsubscribe = unsub
+	r.publish(clusterEvent{Type: clusterPeerSync})
+}
+
+// publish publishes a room event for the other instances.
+func (r *Room) publish(ev clusterEvent) {
+	if r.hub.Bus == nil {
+		return
+	}
+
+	ev.Node = r.hub.node
+	b, err := json.Marshal(ev)
+	if err != nil {
+		r.hub.log.Printf("error encoding cluster event: %v", err)
+		return
+	}
+	if err := r.hub.Bus.Publish(r.ID, b); err != nil {
+		r.hub.log.Printf("error publishing cluster event for room %s: %v", r.ID, err)
+	}
+}
+
+// processClusterEvent applies an event published by another instance to
+// the room. It must be called from the room's goroutine and returns true
+// when the room was disposed.
+func (r *Room) processClusterEvent(b []byte) bool {
+	var ev clusterEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		r.hub.log.Printf("error decoding cluster event: %v", err)
+		return false
+	}
+
+	// Ignore the events published by this instance.
+	if ev.Node == r.hub.node {
+		return false
+	}
+
+	switch ev.Type {
+	case clusterBroadcast:
+		r.raiseSeq(payloadSeq(ev.Payload))
+		r.fanout(ev.Payload)
+		if ev.Record {
+			r.recordMsgPayload([]byte(ev.Payload))
+			if m, ok := decodeMessage(ev.Payload); ok && m.Data.(*payloadMsgChat).ExpiresAt != nil {
+				c := m.Data.(*payloadMsgChat)
+				r.expireAt(c.ID, *c.ExpiresAt, false)
+			}
+		}
+
+	// A message was edited or deleted, update the cached one.
+	case clusterEdit:
+		r.replaceCached(ev.Payload)
+		if m, ok := decodeMessage(ev.Payload); ok && m.Data.(*payloadMsgChat).Deleted {
+			r.clearReactions(m.Data.(*payloadMsgChat).ID)
+			r.dropEdits(m.Data.(*payloadMsgChat).ID, false)
+			r.scrubQuotes(m.Data.(*payloadMsgChat).ID, false)
+		}
+
+	case clusterReaction:
+		r.raiseSeq(payloadSeq(ev.Payload))
+		r.processClusterReaction(ev.Payload)
+
+	case clusterPeerJoin:
+		if ev.Peer != nil {
+			r.remotePeers[ev.Peer.ID] = *ev.Peer
+		}
+
+	// A peer changed its handle, the rename is broadcast separately.
+	case clusterHandle:
+		if ev.Peer != nil {
+			r.remotePeers[ev.Peer.ID] = *ev.Peer
+		}
+
+	case clusterPeerLeave:
+		if ev.Peer != nil {
+			delete(r.remotePeers, ev.Peer.ID)
+			delete(r.readMarks, ev.Peer.ID)
+		}
+
+	// A new instance joined the room, announce the local peers.
+	case clusterPeerSync:
+		for p := range r.peers {
+			r.publish(clusterEvent{Type: clusterPeerJoin, Peer: p.msgPeer()})
+		}
+		for _, l := range r.leaving {
+			r.publish(clusterEvent{Type: clusterPeerJoin, Peer: l.peer.msgPeer()})
+		}
+
+	// Only the instance of the recipient acknowledges the delivery.
+	case clusterForward:
+		if p := r.peerByHandle(ev.To); p != nil {
+			from := ev.Peer
+			if from == nil {
+				from = p.msgPeer()
+			}
+			p.SendData(r.makeForwardPayload(ev.Data, from, ev.ReqType))
+			if ev.Peer != nil {
+				r.publish(clusterEvent{Type: clusterDelivery, To: ev.Peer.ID,
+					Data: payloadDelivery{To: ev.To, Type: ev.ReqType, Ref: forwardRef(ev.Data)}})
+			}
+		}
+
+	case clusterMention:
+		if p := r.peerByHandle(ev.To); p != nil {
+			p.SendData(r.makePayload(ev.Data, TypeMention))
+		}
+
+	case clusterDelivery:
+		if p := r.peerByID(ev.To); p != nil {
+			p.SendData(r.makePayload(ev.Data, TypeDelivered))
+		}
+
+	case clusterRead:
+		r.raiseSeq(payloadSeq(ev.Payload))
+		r.processClusterRead(ev.Payload)
+
+	case clusterTopic, clusterPins:
+		r.raiseSeq(payloadSeq(ev.Payload))
+		r.processClusterMeta(ev.Type, ev.Payload)
+
+	case clusterModerate:
+		r.applyModeration(ev.ReqType, ev.To)
+
+	case clusterRole:
+		r.applyRole(ev.To, ev.ReqType)
+
+	case clusterDispose:
+		return !r.Predefined
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store/mem"
+)
+
+// newTestCluster returns two hubs sharing an in-memory store and bus, and a
+// room active on both.
+func newTestCluster(t *testing.T) (*Room, *Room) {
+	t.Helper()
+	st, err := mem.New(mem.Config{})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	bus := mem.NewBus()
+
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		h := NewHub(&Config{
+			RoomIDLen:         8,
+			MaxCachedMessages: 100,
+			RoomAge:           time.Hour,
+		}, st, log.New(ioutil.Discard, "", 0))
+		h.Bus = bus
+		hubs = append(hubs, h)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, h := range hubs {
+			h.Shutdown(ctx)
+		}
+	})
+
+	r1, _, err := hubs[0].AddRoom("room", "password", false)
+	if err != nil {
+		t.Fatalf("error creating room: %v", err)
+	}
+	r2, err := hubs[1].ActivateRoom(r1.ID)
+	if err != nil {
+		t.Fatalf("error activating room: %v", err)
+	}
+	return r1, r2
+}
+
+// cachedSeqs returns the sequence IDs of the payloads cached by a room.
+func cachedSeqs(r *Room) []uint64 {
+	var out []uint64
+	r.do(func() {
+		for _, b := range r.payloadCache {
+			out = append(out, payloadSeq(b))
+		}
+	})
+	return out
+}
+
+func TestClusterSeqs(t *testing.T) {
+	r1, r2 := newTestCluster(t)
+
+	// Both instances broadcast at the same time. The mem bus drops the
+	// messages for full queues, so the traffic is kept under their buffer.
+	const n = 20
+	var wg sync.WaitGroup
+	for _, r := range []*Room{r1, r2} {
+		wg.Add(1)
+		go func(r *Room) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				r.Broadcast(r.makePayload(fmt.Sprintf("notice %d", i), TypeNotice), true)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	// The other instance's payloads arrive asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cachedSeqs(r1)) < 2*n || len(cachedSeqs(r2)) < 2*n {
+		if time.Now().After(deadline) {
+			t.Fatalf("cached %d and %d payloads, want %d", len(cachedSeqs(r1)), len(cachedSeqs(r2)), 2*n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, r := range []*Room{r1, r2} {
+		seen := map[uint64]bool{}
+		for _, s := range cachedSeqs(r) {
+			if seen[s] {
+				t.Fatalf("room on node %s cached sequence ID %d twice", r.hub.node, s)
+			}
+			seen[s] = true
+		}
+		if len(seen) != 2*n {
+			t.Fatalf("room on node %s cached %d payloads, want %d", r.hub.node, len(seen), 2*n)
+		}
+	}
+}
+
+func TestClusterSeqsCatchUp(t *testing.T) {
+	r1, r2 := newTestCluster(t)
+
+	// An instance that has seen higher IDs than the shared counter, like
+	// after a restart of the store, doesn't hand out lower ones.
+	r1.raiseSeq(1000)
+	if seq := r1.nextSeq(); seq <= 1000 {
+		t.Fatalf("next sequence ID = %d, want > 1000", seq)
+	}
+	a, b := r1.nextSeq(), r2.nextSeq()
+	if a == b || a <= 1000 || b <= 1000 {
+		t.Fatalf("next sequence IDs = %d and %d, want distinct IDs > 1000", a, b)
+	}
+}
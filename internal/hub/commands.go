@@ -0,0 +1,206 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CommandFunc runs a slash command for a peer with the text following the
+// command's name. The error, if any, is sent to the peer as a notice.
+type CommandFunc func(p *Peer, args string) error
+
+// Command is a slash command the peers can run from their chat messages,
+// like "/me waves". The messages of encrypted rooms can't be read by the
+// server, their commands are left to the clients.
+type Command struct {
+	// Name of the command, without the slash.
+	Name string
+
+	// Usage and description shown by /help.
+	Usage string
+	Help  string
+
+	// Run is called from the room's goroutine.
+	Run CommandFunc
+}
+
+// ErrCommandUsage is returned by the commands run with invalid arguments.
+// The peer is sent the command's usage.
+var ErrCommandUsage = errors.New("invalid arguments")
+
+// builtinCommands are registered with every hub.
+var builtinCommands = []Command{
+	{Name: "help", Usage: "/help [command]?", Help: "Show commands help", Run: cmdHelp},
+	{Name: "who", Usage: "/who", Help: "List the peers in the room", Run: cmdWho},
+	{Name: "me", Usage: "/me [action]", Help: "Send an action, like /me waves", Run: cmdMe},
+	{Name: "nick", Usage: "/nick [handle]", Help: "Change your handle", Run: cmdNick},
+	{Name: "topic", Usage: "/topic [text]?", Help: "Set the topic of the room, or clear it", Run: cmdTopic},
+	{Name: "growl", Usage: "/growl [user] [message]", Help: "Send a growl notification to an user", Run: cmdForward(TypeGrowl)},
+	{Name: "ping", Usage: "/ping [user] [message]", Help: "Send a ping notification to an user", Run: cmdForward(TypePing)},
+	{Name: "whisper", Usage: "/whisper [user] [message]", Help: "Send a message to a specific user", Run: cmdForward(TypeWhisper)},
+	{Name: "kick", Usage: "/kick [user]", Help: "Disconnect an user from the room", Run: cmdModerate(TypePeerKick)},
+	{Name: "ban", Usage: "/ban [user]", Help: "Disconnect an user and prevent it from joining again", Run: cmdModerate(TypePeerBan)},
+	{Name: "mute", Usage: "/mute [user]", Help: "Make an user read-only", Run: cmdModerate(TypePeerMute)},
+	{Name: "unmute", Usage: "/unmute [user]", Help: "Let a muted user write again", Run: cmdModerate(TypePeerUnmute)},
+	{Name: "promote", Usage: "/promote [user]", Help: "Make an user a moderator of the room", Run: cmdRole(RoleModerator)},
+	{Name: "demote", Usage: "/demote [user]", Help: "Remove the moderator role of an user", Run: cmdRole(RolePeer)},
+}
+
+// RegisterCommand adds a slash command to the hub's rooms, replacing the
+// command with the same name if any.
+func (h *Hub) RegisterCommand(c Command) error {
+	if c.Name == "" || strings.ContainsAny(c.Name, " /") || c.Run == nil {
+		return errors.New("invalid command")
+	}
+
+	h.commandMut.Lock()
+	h.commands[strings.ToLower(c.Name)] = c
+	h.commandMut.Unlock()
+	return nil
+}
+
+// Commands returns the hub's slash commands, sorted by name.
+func (h *Hub) Commands() []Command {
+	h.commandMut.RLock()
+	out := make([]Command, 0, len(h.commands))
+	for _, c := range h.commands {
+		out = append(out, c)
+	}
+	h.commandMut.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// runCommand runs the slash command in a peer's message.
+func (h *Hub) runCommand(p *Peer, msg string) {
+	name, args := strings.TrimPrefix(msg, "/"), ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+
+	h.commandMut.RLock()
+	c, ok := h.commands[strings.ToLower(name)]
+	h.commandMut.RUnlock()
+	if !ok {
+		p.SendData(p.room.makePayload(fmt.Sprintf("unknown command /%s, see /help", name), TypeNotice))
+		return
+	}
+
+	p.room.do(func() {
+		if err := c.Run(p, args); err != nil {
+			if err == ErrCommandUsage {
+				p.SendData(p.room.makePayload("usage: "+c.Usage, TypeNotice))
+				return
+			}
+			p.SendData(p.room.makePayload(err.Error(), TypeNotice))
+		}
+	})
+}
+
+// Reply sends the output of a command to the peer.
+func (p *Peer) Reply(text string) {
+	p.SendData(p.room.makePayload(text, TypeCommandOutput))
+}
+
+func cmdHelp(p *Peer, args string) error {
+	var b strings.Builder
+	for _, c := range p.room.hub.Commands() {
+		if args != "" && c.Name != strings.TrimPrefix(args, "/") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", c.Usage, c.Help)
+	}
+	if b.Len() == 0 {
+		return fmt.Errorf("unknown command %s", args)
+	}
+	p.Reply(strings.TrimSuffix(b.String(), "\n"))
+	return nil
+}
+
+func cmdWho(p *Peer, args string) error {
+	var who []string
+	for _, m := range p.room.peerList() {
+		if m.Role != RolePeer {
+			who = append(who, m.Handle+" ("+m.Role+")")
+		} else {
+			who = append(who, m.Handle)
+		}
+	}
+	sort.Strings(who)
+	p.Reply(fmt.Sprintf("%d peer(s): %s", len(who), strings.Join(who, ", ")))
+	return nil
+}
+
+func cmdMe(p *Peer, args string) error {
+	if args == "" {
+		return ErrCommandUsage
+	}
+	p.postMessage(args, "", 0, true)
+	return nil
+}
+
+func cmdNick(p *Peer, args string) error {
+	if args == "" {
+		return ErrCommandUsage
+	}
+	p.room.changeHandle(p, args)
+	return nil
+}
+
+func cmdTopic(p *Peer, args string) error {
+	if len(args) > maxTopicLen {
+		return errors.New("the topic is too long")
+	}
+	p.room.setTopic(p, args)
+	return nil
+}
+
+// cmdForward returns the command sending a growl, a ping or a whisper.
+func cmdForward(typ string) CommandFunc {
+	return func(p *Peer, args string) error {
+		f := strings.Fields(args)
+		if len(f) == 0 || (typ != TypePing && len(f) < 2) {
+			return ErrCommandUsage
+		}
+		to, msg := f[0], strings.TrimSpace(strings.TrimPrefix(args, f[0]))
+		if p.room.muted(p) {
+			return errors.New("you are muted in this room")
+		}
+
+		if typ == TypeGrowl {
+			p.room.growl(p.Handle, to, msg)
+			return nil
+		}
+		p.room.forward(forwardReq{reqType: typ, from: p, to: to, data: map[string]interface{}{
+			"to":   to,
+			"msg":  msg,
+			"from": p.Handle,
+		}})
+		return nil
+	}
+}
+
+// cmdModerate returns the command applying a moderation action.
+func cmdModerate(action string) CommandFunc {
+	return func(p *Peer, args string) error {
+		if args == "" || strings.ContainsAny(args, " \t\n") {
+			return ErrCommandUsage
+		}
+		p.room.moderate(p, action, args)
+		return nil
+	}
+}
+
+// cmdRole returns the command giving a role to a peer.
+func cmdRole(role string) CommandFunc {
+	return func(p *Peer, args string) error {
+		if args == "" || strings.ContainsAny(args, " \t\n") {
+			return ErrCommandUsage
+		}
+		p.room.setRole(p, args, role)
+		return nil
+	}
+}
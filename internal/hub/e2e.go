@@ -0,0 +1,33 @@
+package hub
+
+import "encoding/base64"
+
+const (
+	// Maximum length of a base64 encoded peer key.
+	maxPeerKeyLen = 1024
+
+	// Minimum length of a decoded ciphertext: a 12 byte IV and a 16 byte
+	// authentication tag.
+	minCiphertextLen = 28
+)
+
+// ValidPeerKey tells if a public key announced by a peer in an encrypted
+// room looks valid. The server only relays the keys between peers.
+func ValidPeerKey(key string) bool {
+	if key == "" || len(key) > maxPeerKeyLen {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(key)
+	return err == nil
+}
+
+// acceptsMessage tells if a message can be relayed by the room. An encrypted
+// room only relays ciphertexts, so that no plaintext is ever cached or
+// stored.
+func (r *Room) acceptsMessage(msg string) bool {
+	if !r.Encrypted {
+		return true
+	}
+	b, err := base64.StdEncoding.DecodeString(msg)
+	return err == nil && len(b) >= minCiphertextLen
+}
@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"encoding/json"
+)
+
+// payloadMsgEdit announces the edition or deletion of a chat message.
+type payloadMsgEdit struct {
+	ID       string `json:"id"`
+	Msg      string `json:"message,omitempty"`
+	ByHandle string `json:"by_handle"`
+}
+
+// editMessage edits or deletes a chat message on behalf of a peer, and
+// announces it to the room. Deleted messages are kept as tombstones without
+// their text. Only their authors and the peers allowed to moderate them can
+// change messages. It must be called from the room's goroutine.
+func (r *Room) editMessage(from *Peer, typ, id, msg string) {
+	old, m, ok := r.findMessage(id)
+	if !ok {
+		from.SendData(r.makePayload("message not found", TypeNotice))
+		return
+	}
+	chat := m.Data.(*payloadMsgChat)
+	if chat.PeerID != from.ID && !r.outranks(from, r.roleByID(chat.PeerID)) {
+		from.SendData(r.makePayload("you are not allowed to change this message", TypeNotice))
+		return
+	}
+	if chat.Deleted {
+		return
+	}
+
+	if typ == TypeMessageEdit {
+		chat.Msg = msg
+		chat.Edited = true
+	} else {
+		chat.Msg = ""
+		chat.Deleted = true
+		r.clearReactions(id)
+		r.dropEdits(id, true)
+		r.scrubQuotes(id, true)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		r.hub.log.Printf("error encoding message: %v", err)
+		return
+	}
+
+	// Late joiners get the updated message, peers resuming after the edit
+	// get the notice.
+	r.replaceCached(b)
+	r.updatePin(b, from.Handle)
+	if r.history.Enabled {
+		if err := r.hub.Store.ReplaceHistory(r.ID, old, b); err != nil {
+			r.hub.log.Printf("error updating history of room %s: %v", r.ID, err)
+		}
+	}
+	r.publish(clusterEvent{Type: clusterEdit, Payload: b})
+
+	n := r.makePayload(payloadMsgEdit{ID: id, Msg: chat.Msg, ByHandle: from.Handle}, typ)
+	r.broadcast(n, true)
+	r.recordHistory(n)
+}
+
+// dropEdits removes the notices of the editions of a deleted chat message,
+// which carry its former text, from the room's cache, and from the
+// persistent history shared by the instances if local. It must be called
+// from the room's goroutine.
+func (r *Room) dropEdits(id string, local bool) {
+	var cache [][]byte
+	for _, b := range r.payloadCache {
+		if typ, ref := payloadRef(b); typ != TypeMessageEdit || ref != id {
+			cache = append(cache, b)
+		}
+	}
+	r.payloadCache = cache
+
+	if !local || !r.history.Enabled {
+		return
+	}
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return
+	}
+	for _, b := range hist {
+		if typ, ref := payloadRef(b); typ != TypeMessageEdit || ref != id {
+			continue
+		}
+		if err := r.hub.Store.DeleteHistory(r.ID, b); err != nil {
+			r.hub.log.Printf("error purging history of room %s: %v", r.ID, err)
+		}
+	}
+}
+
+// recordedPayloads returns the room's persistent history, or its cache if
+// it doesn't have one.
+func (r *Room) recordedPayloads() [][]byte {
+	if !r.history.Enabled {
+		return r.payloadCache
+	}
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return nil
+	}
+	return hist
+}
+
+// findMessage looks up a chat message by ID in the room's recorded payloads.
+// It returns the encoded payload along with the decoded one.
+func (r *Room) findMessage(id string) ([]byte, payloadMsgWrap, bool) {
+	payloads := r.recordedPayloads()
+	for i := len(payloads) - 1; i >= 0; i-- {
+		if m, ok := decodeMessage(payloads[i]); ok && m.Data.(*payloadMsgChat).ID == id {
+			return payloads[i], m, true
+		}
+	}
+	return nil, payloadMsgWrap{}, false
+}
+
+// replaceCached replaces the cached chat message with the ID of the given
+// one.
+func (r *Room) replaceCached(b []byte) {
+	m, ok := decodeMessage(b)
+	if !ok {
+		return
+	}
+	id := m.Data.(*payloadMsgChat).ID
+	for i, c := range r.payloadCache {
+		if cm, ok := decodeMessage(c); ok && cm.Data.(*payloadMsgChat).ID == id {
+			r.payloadCache[i] = b
+			return
+		}
+	}
+}
+
+// decodeMessage decodes an encoded chat message that has an ID.
+func decodeMessage(b []byte) (payloadMsgWrap, bool) {
+	m := payloadMsgWrap{Data: &payloadMsgChat{}}
+	if err := json.Unmarshal(b, &m); err != nil || m.Type != TypeMessage {
+		return m, false
+	}
+	c, ok := m.Data.(*payloadMsgChat)
+	return m, ok && c.ID != ""
+}
@@ -0,0 +1,161 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// payloadMsgExpired announces the removal of a chat message at the end of
+// its lifetime.
+type payloadMsgExpired struct {
+	ID string `json:"id"`
+}
+
+// expiry is the scheduled removal of a chat message. Only the instance the
+// message was sent from, or loaded from the persistent history by, purges
+// it from the history shared by the instances.
+type expiry struct {
+	at    time.Time
+	local bool
+}
+
+// messageLifetime returns the lifetime of a chat message, the shorter of the
+// one its sender asked for and the room's, if any.
+func (r *Room) messageLifetime(requested time.Duration) time.Duration {
+	ttl := r.messageTTL
+	if requested > 0 && (ttl == 0 || requested < ttl) {
+		ttl = requested
+	}
+	return ttl
+}
+
+// expireAt schedules the removal of a chat message, sent from this instance
+// if local. It must be called from the room's goroutine.
+func (r *Room) expireAt(id string, at time.Time, local bool) {
+	r.expiring[id] = expiry{at: at, local: local}
+	r.expireMessages()
+}
+
+// expireMessages removes the chat messages at the end of their lifetime, and
+// schedules the next check if some remain.
+func (r *Room) expireMessages() {
+	var next time.Duration
+	for id, e := range r.expiring {
+		left := time.Until(e.at)
+		if left <= 0 {
+			delete(r.expiring, id)
+			r.purgeMessage(id, e.local)
+			continue
+		}
+		if next == 0 || left < next {
+			next = left
+		}
+	}
+	if next > 0 {
+		r.expiryTick = time.After(next)
+	}
+}
+
+// purgeMessage removes a chat message, along with the notices of its
+// edition, from the room's cache and tells the local peers to erase it.
+// Every instance serving the room purges its own peers' copies, the local
+// one also purges the persistent history and records the removal there. It
+// must be called from the room's goroutine.
+func (r *Room) purgeMessage(id string, local bool) {
+	r.clearReactions(id)
+	if r.unpin(id) {
+		r.saveMeta()
+		r.fanout(r.makePinsPayload(""))
+	}
+
+	var cache [][]byte
+	for _, b := range r.payloadCache {
+		if !refersTo(b, id) {
+			cache = append(cache, b)
+		}
+	}
+	r.payloadCache = cache
+
+	// The message may have been purged already by another instance that
+	// loaded it from the history, the notice is recorded once.
+	var purged bool
+	if local && r.history.Enabled {
+		hist, err := r.hub.Store.GetHistory(r.ID)
+		if err != nil {
+			r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		}
+		for _, b := range hist {
+			if !refersTo(b, id) {
+				continue
+			}
+			if err := r.hub.Store.DeleteHistory(r.ID, b); err != nil {
+				r.hub.log.Printf("error purging history of room %s: %v", r.ID, err)
+				continue
+			}
+			purged = true
+		}
+	}
+
+	// Peers resuming after the removal get the notice too.
+	b := r.makePayload(payloadMsgExpired{ID: id}, TypeMessageExpired)
+	r.fanout(b)
+	r.recordMsgPayload(b)
+	if purged {
+		r.recordHistory(b)
+	}
+}
+
+// loadExpiries schedules the removal of the chat messages with a lifetime
+// in the room's persistent history, which outlive restarts.
+func (r *Room) loadExpiries() {
+	if !r.history.Enabled {
+		return
+	}
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return
+	}
+
+	var next time.Time
+	for _, b := range hist {
+		m, ok := decodeMessage(b)
+		if !ok || m.Data.(*payloadMsgChat).ExpiresAt == nil {
+			continue
+		}
+		c := m.Data.(*payloadMsgChat)
+		r.expiring[c.ID] = expiry{at: *c.ExpiresAt, local: true}
+		if next.IsZero() || c.ExpiresAt.Before(next) {
+			next = *c.ExpiresAt
+		}
+	}
+	if !next.IsZero() {
+		r.expiryTick = time.After(time.Until(next))
+	}
+}
+
+// refersTo tells if an encoded payload is the chat message with the given
+// ID or a notice of its edition.
+func refersTo(b []byte, id string) bool {
+	typ, ref := payloadRef(b)
+	switch typ {
+	case TypeMessage, TypeMessageEdit, TypeMessageDelete:
+		return ref == id
+	}
+	return false
+}
+
+// payloadRef returns the type of an encoded payload and the ID in its data,
+// if any.
+func payloadRef(b []byte) (string, string) {
+	var m struct {
+		Type string `json:"type"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", ""
+	}
+	return m.Type, m.Data.ID
+}
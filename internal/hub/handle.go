@@ -0,0 +1,65 @@
+package hub
+
+import "strings"
+
+// Maximum length in bytes of a handle a peer changes to.
+const maxHandleLen = 50
+
+// payloadHandle announces the change of a peer's handle.
+type payloadHandle struct {
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	OldHandle  string `json:"old_handle"`
+}
+
+// changeHandle changes the handle of a peer and announces it to the room.
+// It must be called from the room's goroutine.
+func (r *Room) changeHandle(p *Peer, handle string) {
+	if handle == p.Handle {
+		return
+	}
+	if handle == "" || len(handle) > maxHandleLen || strings.ContainsAny(handle, " \t\n") {
+		p.SendData(r.makePayload("invalid handle", TypeNotice))
+		return
+	}
+	if r.muted(p) {
+		p.SendData(r.makePayload("you are muted in this room", TypeNotice))
+		return
+	}
+	if r.isPredefinedUser(handle) || r.bannedHandles[handle] || r.handleTaken(handle) {
+		p.SendData(r.makePayload("this handle is not available", TypeNotice))
+		return
+	}
+
+	if err := r.hub.Store.AddSession(p.ID, handle, p.Role, r.ID, r.hub.Config().RoomAge); err != nil {
+		r.hub.log.Printf("error updating session handle: %v", err)
+		p.SendData(r.makePayload("error changing the handle", TypeNotice))
+		return
+	}
+
+	old := p.Handle
+	p.Handle = handle
+	r.publish(clusterEvent{Type: clusterHandle, Peer: p.msgPeer()})
+	r.broadcast(r.makePayload(payloadHandle{PeerID: p.ID, PeerHandle: handle, OldHandle: old}, TypeHandle), true)
+	r.hub.log.Printf("%s@%s: is now %s in %s", old, p.ID, handle, r.ID)
+}
+
+// handleTaken tells if a peer with the given handle is connected to the
+// room, on this instance or on another one. It must be called from the
+// room's goroutine.
+func (r *Room) handleTaken(handle string) bool {
+	if r.peerByHandle(handle) != nil {
+		return true
+	}
+	for _, l := range r.leaving {
+		if l.peer.Handle == handle {
+			return true
+		}
+	}
+	for _, p := range r.remotePeers {
+		if p.Handle == handle {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,13 @@
 package hub
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/knadh/niltalk/internal/notify"
@@ -31,6 +34,57 @@ const (
 	TypePing            = "ping"
 	TypeWhisper         = "whisper"
 	TypeMotd            = "motd"
+	TypeServerRestart   = "server.restart"
+
+	// Moderation requests and the notices announcing them.
+	TypePeerKick    = "peer.kick"
+	TypePeerBan     = "peer.ban"
+	TypePeerMute    = "peer.mute"
+	TypePeerUnmute  = "peer.unmute"
+	TypePeerKicked  = "peer.kicked"
+	TypePeerBanned  = "peer.banned"
+	TypePeerMuted   = "peer.muted"
+	TypePeerUnmuted = "peer.unmuted"
+
+	// Role changes.
+	TypePeerPromote = "peer.promote"
+	TypePeerDemote  = "peer.demote"
+	TypePeerRole    = "peer.role"
+
+	// Edition and deletion of chat messages.
+	TypeMessageEdit   = "message.edit"
+	TypeMessageDelete = "message.delete"
+
+	// Request for the messages of a reply thread, and the response.
+	TypeThread = "thread"
+
+	// Reaction to a message, and the reactions to the room's messages sent
+	// to joining peers.
+	TypeReaction  = "reaction"
+	TypeReactions = "reactions"
+
+	// Acknowledgements of forwarded whispers and pings.
+	TypeDelivered   = "delivered"
+	TypeUndelivered = "undelivered"
+
+	// Read marker of a peer, and the markers sent to joining peers.
+	TypeRead     = "read"
+	TypeReadList = "read.list"
+
+	// Removal of a chat message at the end of its lifetime.
+	TypeMessageExpired = "message.expired"
+
+	// Room topic, pinning of chat messages, and the pinned messages.
+	TypeRoomTopic    = "room.topic"
+	TypeMessagePin   = "message.pin"
+	TypeMessageUnpin = "message.unpin"
+	TypePins         = "pins"
+
+	// Output of a slash command, sent to the peer who ran it.
+	TypeCommandOutput = "command.output"
+
+	// Highlight of a chat message mentioning the peer.
+	TypeMention = "mention"
 )
 
 // Config represents the app configuration.
@@ -47,10 +101,14 @@ type Config struct {
 	RateLimitInterval time.Duration `koanf:"rate_limit_interval"`
 	RateLimitMessages int           `koanf:"rate_limit_messages"`
 	MaxRooms          int           `koanf:"max_rooms"`
+	EvictIdleRooms    bool          `koanf:"evict_idle_rooms"`
 	MaxPeersPerRoom   int           `koanf:"max_peers_per_room"`
 	PeerHandleFormat  string        `koanf:"peer_handle_format"`
 	RoomTimeout       time.Duration `koanf:"room_timeout"`
 	RoomAge           time.Duration `koanf:"room_age"`
+	ReconnectGrace    time.Duration `koanf:"reconnect_grace"`
+	ShutdownTimeout   time.Duration `koanf:"shutdown_timeout"`
+	ReconnectHint     time.Duration `koanf:"reconnect_hint"`
 	SessionCookie     string        `koanf:"session_cookie"`
 	Storage           string        `koanf:"storage"`
 
@@ -67,6 +125,35 @@ type PredefinedRoom struct {
 	Growl    notify.Options   `koanf:"growl"`
 	Users    []PredefinedUser `koanf:"users"`
 	Motd     string           `koanf:"motd"`
+	History  HistoryOptions   `koanf:"history"`
+	Mailbox  MailboxOptions   `koanf:"mailbox"`
+	// Lifetime of the room's chat messages, after which they're removed.
+	// 0 keeps them, unless their senders give them a shorter one.
+	MessageTTL time.Duration `koanf:"message_ttl"`
+	// Predefined users that are owners of the room.
+	Admins []string `koanf:"admins"`
+}
+
+// HistoryOptions configures the persistent message history of a room.
+type HistoryOptions struct {
+	Enabled bool `koanf:"enabled"`
+	// Maximum number of chat and upload payloads kept. Defaults to
+	// app.max_cached_messages.
+	MaxMessages int `koanf:"max_messages"`
+	// How long a payload is kept. 0 keeps it until it's pushed out by
+	// newer payloads.
+	TTL time.Duration `koanf:"ttl"`
+}
+
+// MailboxOptions configures the queueing of whispers to the room's
+// predefined users while they are offline.
+type MailboxOptions struct {
+	Enabled bool `koanf:"enabled"`
+	// Maximum number of whispers queued per user. Defaults to
+	// app.max_cached_messages.
+	MaxMessages int `koanf:"max_messages"`
+	// How long a whisper is queued. 0 keeps it until the user logs in.
+	TTL time.Duration `koanf:"ttl"`
 }
 
 // PredefinedUser are static users declared in the configuration file.
@@ -74,55 +161,214 @@ type PredefinedUser struct {
 	Name     string `koanf:"name"`
 	Password string `koanf:"password"`
 	Growl    bool   `koanf:"growl"`
+	// How the user is notified when growling, on the server's desktop by
+	// default.
+	Notify notify.UserOptions `koanf:"notify"`
+}
+
+// ErrMaxRooms is returned when a room can't be activated because the hub
+// already holds app.max_rooms rooms.
+var ErrMaxRooms = errors.New("too many active rooms, try again later")
+
+// ErrShuttingDown is returned when a room or a session can't be created
+// because the server is shutting down.
+var ErrShuttingDown = errors.New("server is restarting, try again shortly")
+
+// Room lookup errors.
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomExists   = errors.New("room already exists")
+)
+
+// Stats are counters of the hub's room admission control.
+type Stats struct {
+	RoomsRefused uint64
+	RoomsEvicted uint64
 }
 
 // Hub acts as the controller and container for all chat rooms.
 type Hub struct {
+	// Admission control counters, accessed atomically.
+	roomsRefused uint64
+	roomsEvicted uint64
+
+	// Set when the hub starts shutting down, accessed atomically.
+	closing int32
+
 	Store store.Store
 	rooms map[string]*Room
+	// Slots admitted for rooms being activated, guarded by mut.
+	reserved int
+
+	// Bus fans out room events to the other instances in cluster mode.
+	// It is nil when the instance runs alone.
+	Bus  store.Bus
+	node string
 
-	cfg *Config
+	// Current *Config, replaced as a whole on reload.
+	cfg atomic.Value
 	mut sync.RWMutex
 	log *log.Logger
+
+	// Slash commands by name.
+	commands   map[string]Command
+	commandMut sync.RWMutex
 }
 
 // NewHub returns a new instance of Hub.
 func NewHub(cfg *Config, store store.Store, l *log.Logger) *Hub {
-	return &Hub{
-		rooms: make(map[string]*Room),
+	node, err := GenerateGUID(16)
+	if err != nil {
+		l.Fatalf("error generating node ID: %v", err)
+	}
+	h := &Hub{
+		rooms:    make(map[string]*Room),
+		node:     node,
+		commands: make(map[string]Command),
 
-		cfg:   cfg,
 		Store: store,
 		log:   l,
 	}
+	h.cfg.Store(cfg)
+	for _, c := range builtinCommands {
+		h.RegisterCommand(c)
+	}
+	return h
+}
+
+// Config returns the hub's current configuration, which must not be modified.
+func (h *Hub) Config() *Config {
+	return h.cfg.Load().(*Config)
+}
+
+// SetConfig replaces the hub's configuration. New values apply to the rooms
+// and peers as they read them, predefined rooms have to be reconfigured with
+// ReconfigureRoom.
+func (h *Hub) SetConfig(cfg *Config) {
+	h.mut.Lock()
+	h.cfg.Store(cfg)
+	h.mut.Unlock()
+}
+
+// updateConfig replaces the hub's configuration with a copy changed by f,
+// unless f returns an error. The copy's rooms can be changed. f is called
+// with the hub locked.
+func (h *Hub) updateConfig(f func(cfg *Config) error) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	cfg := *h.Config()
+	cfg.Rooms = make(map[string]PredefinedRoom, len(cfg.Rooms))
+	for k, pr := range h.Config().Rooms {
+		cfg.Rooms[k] = pr
+	}
+	if err := f(&cfg); err != nil {
+		return err
+	}
+	h.cfg.Store(&cfg)
+	return nil
+}
+
+// PredefinedRooms returns the predefined rooms of the configuration, by ID.
+func (h *Hub) PredefinedRooms() map[string]PredefinedRoom {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	out := make(map[string]PredefinedRoom)
+	for _, pr := range h.Config().Rooms {
+		out[pr.ID] = pr
+	}
+	return out
+}
+
+// ReconfigureRoom applies the options of a predefined room to the active
+// room, along with its growl handler.
+func (h *Hub) ReconfigureRoom(pr PredefinedRoom, growl GrowlFunc) error {
+	r := h.GetRoom(pr.ID)
+	if r == nil {
+		return ErrRoomNotFound
+	}
+
+	pwdHash, err := bcrypt.GenerateFromPassword([]byte(pr.Password), 8)
+	if err != nil {
+		h.log.Printf("error hashing password: %v", err)
+		return err
+	}
+	sr := store.Room{ID: pr.ID,
+		Name:      pr.Name,
+		CreatedAt: time.Now(),
+		Password:  pwdHash}
+	keepMeta(&sr, h.Store)
+	if err := h.Store.AddRoom(sr, h.Config().RoomAge); err != nil {
+		h.log.Printf("error updating room in the store: %v", err)
+		return errors.New("error updating room")
+	}
+
+	r.do(func() {
+		r.Name = pr.Name
+		r.Password = pwdHash
+		r.PredefinedUsers = append([]PredefinedUser(nil), pr.Users...)
+		r.GrowlHandler = growl
+		r.configure(pr)
+	})
+	return nil
 }
 
 // AddRoom creates a new room in the store, adds it to the hub, and
-// returns the room (which has to be .Run() on a goroutine then).
-func (h *Hub) AddRoom(name, password string) (*Room, error) {
+// returns the room along with the key that makes its creator an owner.
+// An encrypted room only relays the ciphertexts of its peers' messages.
+func (h *Hub) AddRoom(name, password string, encrypted bool) (*Room, string, error) {
 	// Hash the password.
 	pwdHash, err := bcrypt.GenerateFromPassword([]byte(password), 8)
 	if err != nil {
 		h.log.Printf("error hashing password: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 
-	id, err := h.generateRoomID(h.cfg.RoomIDLen, 5)
+	ownerKey, err := GenerateGUID(32)
 	if err != nil {
-		return nil, err
+		h.log.Printf("error generating owner key: %v", err)
+		return nil, "", errors.New("error generating owner key")
+	}
+	ownerHash, err := bcrypt.GenerateFromPassword([]byte(ownerKey), 8)
+	if err != nil {
+		h.log.Printf("error hashing owner key: %v", err)
+		return nil, "", err
+	}
+
+	if h.Closing() {
+		return nil, "", ErrShuttingDown
+	}
+	if err := h.admitRoom(); err != nil {
+		return nil, "", err
+	}
+
+	id, err := h.generateRoomID(h.Config().RoomIDLen, 5)
+	if err != nil {
+		h.releaseRoom()
+		return nil, "", err
 	}
 
 	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: id,
+	r := store.Room{ID: id,
 		Name:      name,
 		CreatedAt: time.Now(),
-		Password:  pwdHash}, h.cfg.RoomAge); err != nil {
+		Password:  pwdHash,
+		OwnerKey:  ownerHash,
+		Encrypted: encrypted}
+	if err := h.Store.AddRoom(r, h.Config().RoomAge); err != nil {
+		h.releaseRoom()
 		h.log.Printf("error creating room in the store: %v", err)
-		return nil, errors.New("error creating room")
+		return nil, "", errors.New("error creating room")
 	}
 
-	// Initialize the room.
-	return h.initRoom(id, name, pwdHash, false), nil
+	// Initialize the room. A room the hub shut down before taking is of no
+	// use without its owner key.
+	room, err := h.initRoom(r, false, true)
+	if err != nil {
+		h.Store.RemoveRoom(id)
+		return nil, "", err
+	}
+	return room, ownerKey, nil
 }
 
 // AddPredefinedRoom creates a predefined room in the store, adds it to the hub.
@@ -136,16 +382,18 @@ func (h *Hub) AddPredefinedRoom(ID, name, password string) (*Room, error) {
 	}
 
 	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: ID,
+	r := store.Room{ID: ID,
 		Name:      name,
 		CreatedAt: time.Now(),
-		Password:  pwdHash}, h.cfg.RoomAge); err != nil {
+		Password:  pwdHash}
+	keepMeta(&r, h.Store)
+	if err := h.Store.AddRoom(r, h.Config().RoomAge); err != nil {
 		h.log.Printf("error creating room in the store: %v", err)
 		return nil, errors.New("error creating room")
 	}
 
 	// Initialize the room.
-	return h.initRoom(ID, name, pwdHash, true), nil
+	return h.initRoom(r, true, false)
 }
 
 // ActivateRoom loads a room from the store into the hub if it's not already active.
@@ -162,8 +410,15 @@ func (h *Hub) ActivateRoom(id string) (*Room, error) {
 		return nil, errors.New("room doesn't exist")
 	}
 
+	if h.Closing() {
+		return nil, ErrShuttingDown
+	}
+	if err := h.admitRoom(); err != nil {
+		return nil, err
+	}
+
 	// Initialize the room.
-	return h.initRoom(r.ID, r.Name, r.Password, false), nil
+	return h.initRoom(r, false, true)
 }
 
 // GetRoom retrives an active room from the hub.
@@ -174,17 +429,126 @@ func (h *Hub) GetRoom(id string) *Room {
 	return r
 }
 
-// initRoom initializes a room on the Hub.
-func (h *Hub) initRoom(id, name string, password []byte, predefined bool) *Room {
-	r := NewRoom(id, name, password, h, predefined)
+// initRoom initializes a room on the Hub, taking the slot reserved by
+// admitRoom if admitted. A room activated concurrently is returned as is.
+// The closing flag is checked again under the lock, for Shutdown to see
+// every room it lets in.
+func (h *Hub) initRoom(sr store.Room, predefined, admitted bool) (*Room, error) {
+	id := sr.ID
+	r := NewRoom(id, sr.Name, sr.Password, h, predefined)
+	r.ownerKey = sr.OwnerKey
+	r.Encrypted = sr.Encrypted
+	r.topic = sr.Topic
+	r.pins = sr.Pins
 	h.mut.Lock()
+	if admitted {
+		h.reserved--
+	}
+	if h.Closing() {
+		h.mut.Unlock()
+		return nil, ErrShuttingDown
+	}
+	if cur, ok := h.rooms[id]; ok && admitted {
+		h.mut.Unlock()
+		return cur, nil
+	}
 	if predefined {
-		r.motd = h.cfg.Rooms[id].Motd
+		r.configure(h.Config().Rooms[id])
 	}
 	h.rooms[id] = r
 	h.mut.Unlock()
+	r.loadSeq()
+	r.loadExpiries()
+	r.subscribe()
 	go r.run()
-	return r
+	return r, nil
+}
+
+// admitRoom reserves a slot for one more room to be activated, evicting the
+// least recently active idle room to make space if that's enabled. The slot
+// is taken by initRoom, or given back with releaseRoom. Predefined rooms are
+// always admitted and never evicted.
+func (h *Hub) admitRoom() error {
+	for {
+		max := h.Config().MaxRooms
+		h.mut.Lock()
+		n := len(h.rooms) + h.reserved
+		if max <= 0 || n < max {
+			h.reserved++
+			h.mut.Unlock()
+			return nil
+		}
+		h.mut.Unlock()
+
+		// Another activation may take the evicted room's slot first.
+		if !h.Config().EvictIdleRooms || !h.evictIdleRoom() {
+			refused := atomic.AddUint64(&h.roomsRefused, 1)
+			h.log.Printf("refused room activation: %d rooms active (%d refused so far)", n, refused)
+			return ErrMaxRooms
+		}
+	}
+}
+
+// releaseRoom gives back a slot reserved by admitRoom for a room that
+// wasn't activated.
+func (h *Hub) releaseRoom() {
+	h.mut.Lock()
+	h.reserved--
+	h.mut.Unlock()
+}
+
+// evictIdleRoom unloads the least recently active room without peers from
+// the hub, leaving it in the store. It returns false if there's none.
+func (h *Hub) evictIdleRoom() bool {
+	rooms := h.getRooms()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].lastActive().Before(rooms[j].lastActive())
+	})
+
+	for _, r := range rooms {
+		if r.Predefined || !r.evict() {
+			continue
+		}
+		evicted := atomic.AddUint64(&h.roomsEvicted, 1)
+		h.log.Printf("evicted idle room %s (%d evicted so far)", r.ID, evicted)
+		return true
+	}
+	return false
+}
+
+// Stats returns the hub's room admission control counters.
+func (h *Hub) Stats() Stats {
+	return Stats{
+		RoomsRefused: atomic.LoadUint64(&h.roomsRefused),
+		RoomsEvicted: atomic.LoadUint64(&h.roomsEvicted),
+	}
+}
+
+// Closing tells if the hub is shutting down.
+func (h *Hub) Closing() bool {
+	return atomic.LoadInt32(&h.closing) == 1
+}
+
+// Shutdown stops accepting new rooms and sessions, tells every connected
+// peer that the server is restarting and when to reconnect, and unloads the
+// rooms, leaving them in the store. It returns when all the rooms have
+// stopped or the context is done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&h.closing, 1)
+
+	hint := h.Config().ReconnectHint
+	for _, r := range h.getRooms() {
+		r.shutdown(hint)
+	}
+
+	for _, r := range h.getRooms() {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 // getRooms returns the list of active rooms.
@@ -198,11 +562,16 @@ func (h *Hub) getRooms() []*Room {
 	return out
 }
 
-// removeRoom removes a room from the hub and the store.
-func (h *Hub) removeRoom(id string) error {
+// deactivateRoom removes a room from the hub, leaving it in the store.
+func (h *Hub) deactivateRoom(id string) {
 	h.mut.Lock()
 	delete(h.rooms, id)
 	h.mut.Unlock()
+}
+
+// removeRoom removes a room from the hub and the store.
+func (h *Hub) removeRoom(id string) error {
+	h.deactivateRoom(id)
 
 	err := h.Store.RemoveRoom(id)
 	if err != nil {
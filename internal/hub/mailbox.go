@@ -0,0 +1,53 @@
+package hub
+
+import "fmt"
+
+// queueMail queues a whisper for an offline predefined user of the room to
+// receive at their next login. It tells if the whisper was queued. It must
+// be called from the room's goroutine.
+func (r *Room) queueMail(fw forwardReq) bool {
+	if !r.mailbox.Enabled || fw.reqType != TypeWhisper || !r.isPredefinedUser(fw.to) {
+		return false
+	}
+
+	b := r.makeForwardPayload(fw.data, fw.from.msgPeer(), TypeWhisper)
+	if err := r.hub.Store.AddMail(r.ID, fw.to, b, r.mailbox.MaxMessages, r.mailbox.TTL); err != nil {
+		r.hub.log.Printf("error queueing whisper for %s in room %s: %v", fw.to, r.ID, err)
+		return false
+	}
+	return true
+}
+
+// sendMail sends a predefined user the whispers queued for them while they
+// were offline, with their count. It must be called from the room's
+// goroutine.
+func (r *Room) sendMail(p *Peer) {
+	if !r.mailbox.Enabled || !r.isPredefinedUser(p.Handle) {
+		return
+	}
+
+	mail, err := r.hub.Store.TakeMail(r.ID, p.Handle)
+	if err != nil {
+		r.hub.log.Printf("error reading mailbox of %s in room %s: %v", p.Handle, r.ID, err)
+		return
+	}
+	if len(mail) == 0 {
+		return
+	}
+
+	p.SendData(r.makePayload(fmt.Sprintf("%d whisper(s) received while you were offline", len(mail)), TypeNotice))
+	for _, b := range mail {
+		p.SendData(b)
+	}
+}
+
+// isPredefinedUser tells if the handle belongs to a predefined user of the
+// room.
+func (r *Room) isPredefinedUser(handle string) bool {
+	for _, u := range r.PredefinedUsers {
+		if u.Name == handle {
+			return true
+		}
+	}
+	return false
+}
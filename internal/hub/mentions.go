@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Maximum number of peers notified of the mentions in a message.
+const maxMentions = 10
+
+var reMention = regexp.MustCompile(`(?:^|\s)@([^\s@]+)`)
+
+// payloadMention highlights a message mentioning the peer.
+type payloadMention struct {
+	ID         string `json:"id"`
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+}
+
+// mentions returns the handles mentioned with @handle in a message.
+func mentions(msg string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, m := range reMention.FindAllStringSubmatch(msg, -1) {
+		h := strings.TrimRight(m[1], ".,:;!?)")
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		out = append(out, h)
+		if len(out) == maxMentions {
+			break
+		}
+	}
+	return out
+}
+
+// notifyMentions highlights a chat message to the peers it mentions, and
+// growls the offline predefined users. The server can't read the messages
+// of encrypted rooms. It must be called from the room's goroutine.
+func (r *Room) notifyMentions(from *Peer, id, msg string) {
+	if r.Encrypted {
+		return
+	}
+
+	d := payloadMention{ID: id, PeerID: from.ID, PeerHandle: from.Handle}
+	for _, h := range mentions(msg) {
+		if h == from.Handle {
+			continue
+		}
+		if p := r.peerByHandle(h); p != nil {
+			p.SendData(r.makePayload(d, TypeMention))
+		} else {
+			for _, p := range r.remotePeers {
+				if p.Handle == h {
+					r.publish(clusterEvent{Type: clusterMention, To: h, Data: d})
+					break
+				}
+			}
+		}
+		r.growl(from.Handle, h, msg)
+	}
+}
@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"sync/atomic"
+
+	"github.com/knadh/niltalk/internal/metrics"
+)
+
+var (
+	metricBroadcasts = metrics.Default.NewCounter("niltalk_messages_broadcast_total",
+		"Payloads broadcast to the peers of the rooms.")
+	metricRateLimited = metrics.Default.NewCounter("niltalk_peers_ratelimited_total",
+		"Peers disconnected for exceeding the rate limits.")
+	metricWSTimeouts = metrics.Default.NewCounter("niltalk_websocket_write_timeouts_total",
+		"Writes to peer websockets that timed out.")
+)
+
+// RegisterMetrics registers gauges of the hub's state on the given registry.
+func (h *Hub) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGauge("niltalk_rooms_active", "Rooms active in the hub.", func() []metrics.Sample {
+		h.mut.RLock()
+		defer h.mut.RUnlock()
+		return []metrics.Sample{{Value: float64(len(h.rooms))}}
+	})
+
+	reg.NewGauge("niltalk_room_peers", "Peers connected to a room.", func() []metrics.Sample {
+		rooms := h.getRooms()
+		out := make([]metrics.Sample, 0, len(rooms))
+		for _, r := range rooms {
+			out = append(out, metrics.Sample{
+				LabelValues: []string{r.ID},
+				Value:       float64(atomic.LoadInt32(&r.numPeers)),
+			})
+		}
+		return out
+	}, "room")
+
+	reg.NewCounterFunc("niltalk_rooms_refused_total", "Room activations refused by app.max_rooms.",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(h.Stats().RoomsRefused)}}
+		})
+	reg.NewCounterFunc("niltalk_rooms_evicted_total", "Idle rooms evicted to make space for others.",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(h.Stats().RoomsEvicted)}}
+		})
+}
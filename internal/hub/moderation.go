@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// payloadMsgModeration is the notice announcing a moderation action to the room.
+type payloadMsgModeration struct {
+	PeerHandle string `json:"peer_handle"`
+	ByHandle   string `json:"by_handle"`
+}
+
+// moderationNotices maps moderation requests to the notices announcing them.
+var moderationNotices = map[string]string{
+	TypePeerKick:   TypePeerKicked,
+	TypePeerBan:    TypePeerBanned,
+	TypePeerMute:   TypePeerMuted,
+	TypePeerUnmute: TypePeerUnmuted,
+}
+
+// moderate applies a moderation action requested by a peer on the peer with
+// the given handle, and announces it to the room. It must be called from the
+// room's goroutine.
+func (r *Room) moderate(from *Peer, action, handle string) {
+	if handle == "" || handle == from.Handle {
+		return
+	}
+	if !r.canModerate(from, handle) {
+		from.SendData(r.makePayload("you are not allowed to moderate this peer", TypeNotice))
+		return
+	}
+
+	r.applyModeration(action, handle)
+	r.publish(clusterEvent{Type: clusterModerate, ReqType: action, To: handle})
+	r.broadcast(r.makePayload(payloadMsgModeration{PeerHandle: handle, ByHandle: from.Handle},
+		moderationNotices[action]), true)
+	r.hub.log.Printf("%s@%s: %s %s in %s", from.Handle, from.ID, action, handle, r.ID)
+}
+
+// applyModeration applies a moderation action to the peer with the given handle.
+// Bans and mutes last for the room's lifetime. They apply to the handle and
+// to the session of the peer, which keeps them if it changes its handle.
+func (r *Room) applyModeration(action, handle string) {
+	p := r.peerByHandle(handle)
+
+	switch action {
+	case TypePeerKick:
+		r.kickPeer(handle, TypePeerKicked)
+
+	case TypePeerBan:
+		r.bannedHandles[handle] = true
+		if p != nil {
+			r.bannedSessions[p.ID] = true
+		}
+		r.kickPeer(handle, TypePeerBanned)
+
+	case TypePeerMute:
+		r.mutedHandles[handle] = true
+		if p != nil {
+			r.mutedSessions[p.ID] = true
+		}
+
+	case TypePeerUnmute:
+		delete(r.mutedHandles, handle)
+		if p != nil {
+			delete(r.mutedSessions, p.ID)
+		}
+	}
+}
+
+// kickPeer removes the session of the local peer with the given handle and
+// closes its connection with the given reason. A peer within its reconnect
+// grace period loses its session and is announced as gone.
+func (r *Room) kickPeer(handle, reason string) {
+	p := r.peerByHandle(handle)
+	if p == nil {
+		for id, l := range r.leaving {
+			if l.peer.Handle == handle {
+				r.kickLeaving(id)
+			}
+		}
+		return
+	}
+	r.hub.Store.RemoveSession(p.ID, r.ID)
+	p.kicked = true
+	p.writeWSControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	p.ws.Close()
+}
+
+// kickLeaving removes the session of a peer within its reconnect grace
+// period and announces its departure right away. It must be called from
+// the room's goroutine.
+func (r *Room) kickLeaving(id string) {
+	l, ok := r.leaving[id]
+	if !ok {
+		return
+	}
+	r.hub.Store.RemoveSession(id, r.ID)
+	l.peer.kicked = true
+	delete(r.leaving, id)
+	r.announceLeave(l.peer)
+}
+
+// isBanned tells if a handle is banned from the room.
+func (r *Room) isBanned(handle string) bool {
+	var banned bool
+	r.do(func() {
+		banned = r.bannedHandles[handle]
+	})
+	return banned
+}
+
+// isMuted tells if a peer is muted in the room. A stopped room has no peers
+// left to mute.
+func (r *Room) isMuted(p *Peer) bool {
+	var muted bool
+	r.do(func() {
+		muted = r.muted(p)
+	})
+	return muted
+}
+
+// muted tells if a peer is muted in the room, through its handle or its
+// session. It must be called from the room's goroutine.
+func (r *Room) muted(p *Peer) bool {
+	return r.mutedHandles[p.Handle] || r.mutedSessions[p.ID]
+}
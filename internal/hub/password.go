@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bounds of the parameters of the argon2id hashes, so that a hash can't
+// make the checks of the passwords exhaust the server.
+const (
+	maxArgon2Memory  = 1 << 20 // KiB
+	maxArgon2Time    = 10
+	maxArgon2KeySize = 128
+)
+
+// HashPassword returns the bcrypt hash of a predefined user's password, to
+// put in the configuration instead of the password.
+func HashPassword(pwd string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// IsPasswordHash tells if a predefined user's password is a bcrypt or an
+// argon2id hash, rather than plain text.
+func IsPasswordHash(pwd string) bool {
+	return isBcrypt(pwd) || strings.HasPrefix(pwd, "$argon2id$")
+}
+
+// ValidatePasswordHash checks a predefined user's password hash, returning
+// an error if it's malformed or its parameters are out of bounds. Plain text
+// passwords are valid.
+func ValidatePasswordHash(pwd string) error {
+	switch {
+	case isBcrypt(pwd):
+		_, err := bcrypt.Cost([]byte(pwd))
+		return err
+	case strings.HasPrefix(pwd, "$argon2id$"):
+		_, err := parseArgon2(pwd)
+		return err
+	}
+	return nil
+}
+
+func isBcrypt(pwd string) bool {
+	return strings.HasPrefix(pwd, "$2a$") || strings.HasPrefix(pwd, "$2b$") ||
+		strings.HasPrefix(pwd, "$2y$")
+}
+
+// checkUserPassword tells if a password matches the configured password of a
+// predefined user, a hash or plain text. Plain text passwords are compared
+// through their digests so the comparison doesn't depend on their lengths.
+func checkUserPassword(conf, pwd string) bool {
+	switch {
+	case isBcrypt(conf):
+		return bcrypt.CompareHashAndPassword([]byte(conf), []byte(pwd)) == nil
+	case strings.HasPrefix(conf, "$argon2id$"):
+		return checkArgon2(conf, pwd)
+	}
+	a, b := sha256.Sum256([]byte(conf)), sha256.Sum256([]byte(pwd))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// argon2Hash is a decoded argon2id hash.
+type argon2Hash struct {
+	mem, time uint32
+	threads   uint8
+	salt, key []byte
+}
+
+// parseArgon2 decodes an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash, and checks its parameters.
+func parseArgon2(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return h, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.mem, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	if h.threads < 1 || h.time < 1 || h.time > maxArgon2Time ||
+		h.mem < 8*uint32(h.threads) || h.mem > maxArgon2Memory {
+		return h, fmt.Errorf("argon2id parameters out of bounds, m must be at most %d and t at most %d",
+			maxArgon2Memory, maxArgon2Time)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return h, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+	if len(h.key) == 0 || len(h.key) > maxArgon2KeySize {
+		return h, errors.New("invalid argon2id key length")
+	}
+	return h, nil
+}
+
+// checkArgon2 tells if a password matches an argon2id hash.
+func checkArgon2(hash, pwd string) bool {
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	out := argon2.IDKey([]byte(pwd), h.salt, h.time, h.mem, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(out, h.key) == 1
+}
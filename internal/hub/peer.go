@@ -2,6 +2,9 @@ package hub
 
 import (
 	"encoding/json"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,11 +16,28 @@ type Peer struct {
 	ID     string
 	Handle string
 
+	// Peer's role in the room.
+	Role string
+
+	// Public key the peer announced in an encrypted room.
+	Key string
+
+	// Sequence ID of the last payload received by a reconnecting peer.
+	since uint64
+
+	// The peer was kicked out and doesn't get a reconnect grace period.
+	kicked bool
+
 	ws *websocket.Conn
 
 	// Channel for outbound messages.
 	dataQ chan []byte
 
+	// Closed when the peer is removed from the room, after which the
+	// payloads sent to it are dropped.
+	closed    chan struct{}
+	closeOnce sync.Once
+
 	// Peer's room.
 	room *Room
 
@@ -32,21 +52,28 @@ type peerInfo struct {
 }
 
 // newPeer returns a new instance of Peer.
-func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
+func newPeer(id, handle, role string, ws *websocket.Conn, room *Room) *Peer {
 	return &Peer{
 		ID:     id,
 		Handle: handle,
+		Role:   role,
 		ws:     ws,
 		dataQ:  make(chan []byte, 100),
+		closed: make(chan struct{}),
 		room:   room,
 	}
 }
 
+// msgPeer returns the peer's info for the peer payloads.
+func (p *Peer) msgPeer() *payloadMsgPeer {
+	return &payloadMsgPeer{ID: p.ID, Handle: p.Handle, Role: p.Role, Key: p.Key}
+}
+
 // RunListener is a blocking function that reads incoming messages from a peer's
 // WS connection until its dropped or there's an error. This should be invoked
 // as a goroutine.
 func (p *Peer) RunListener() {
-	p.ws.SetReadLimit(int64(p.room.hub.cfg.MaxMessageLen))
+	p.ws.SetReadLimit(int64(p.room.hub.Config().MaxMessageLen))
 	for {
 		_, m, err := p.ws.ReadMessage()
 		if err != nil {
@@ -70,27 +97,60 @@ func (p *Peer) RunWriter() {
 	for {
 		select {
 		// Wait for outgoing message to appear in the channel.
-		case message, ok := <-p.dataQ:
-			if !ok {
-				p.writeWSData(websocket.CloseMessage, []byte{})
-				return
-			}
+		case message := <-p.dataQ:
 			if err := p.writeWSData(websocket.TextMessage, message); err != nil {
 				return
 			}
+
+		// The peer was removed from the room, write the messages queued
+		// before and close the connection.
+		case <-p.closed:
+			for {
+				select {
+				case message := <-p.dataQ:
+					if err := p.writeWSData(websocket.TextMessage, message); err != nil {
+						return
+					}
+				default:
+					p.writeWSData(websocket.CloseMessage, []byte{})
+					return
+				}
+			}
 		}
 	}
 }
 
-// SendData queues a message to be written to the peer's WS.
+// SendData queues a message to be written to the peer's WS. It's safe to call
+// from any goroutine, messages sent after the peer was removed from the room
+// are dropped.
 func (p *Peer) SendData(b []byte) {
-	p.dataQ <- b
+	select {
+	case <-p.closed:
+		return
+	default:
+	}
+	select {
+	case p.dataQ <- b:
+	case <-p.closed:
+	}
+}
+
+// close stops the delivery of the messages to the peer, once the ones already
+// queued are written.
+func (p *Peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
 }
 
 // writeWSData writes the given payload to the peer's WS connection.
 func (p *Peer) writeWSData(msgType int, payload []byte) error {
-	p.ws.SetWriteDeadline(time.Now().Add(p.room.hub.cfg.WSTimeout))
-	return p.ws.WriteMessage(msgType, payload)
+	p.ws.SetWriteDeadline(time.Now().Add(p.room.hub.Config().WSTimeout))
+	err := p.ws.WriteMessage(msgType, payload)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		metricWSTimeouts.Inc()
+	}
+	return err
 }
 
 // writeWSControl writes the given control payload to the peer's WS connection.
@@ -98,6 +158,62 @@ func (p *Peer) writeWSControl(control int, payload []byte) error {
 	return p.ws.WriteControl(websocket.CloseMessage, payload, time.Time{})
 }
 
+// rateLimited checks the peer's rate limits and updates its counters. A peer
+// over the limits is disconnected and its session removed.
+func (p *Peer) rateLimited() bool {
+	now := time.Now()
+	if p.numMessages > 0 {
+		if (p.numMessages%p.room.hub.Config().RateLimitMessages+1) >= p.room.hub.Config().RateLimitMessages &&
+			time.Since(p.lastMessage) < p.room.hub.Config().RateLimitInterval {
+			p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
+			metricRateLimited.Inc()
+			p.writeWSControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
+			p.ws.Close()
+			return true
+		}
+	}
+	p.lastMessage = now
+	p.numMessages++
+	return false
+}
+
+// postMessage posts a chat message of the peer to the room, replying to the
+// message with the given ID if any. /me messages are actions. It must be
+// called from the room's goroutine.
+func (p *Peer) postMessage(msg, replyTo string, ttl time.Duration, action bool) {
+	if p.room.muted(p) {
+		p.SendData(p.room.makePayload("you are muted in this room", TypeNotice))
+		return
+	}
+
+	var quote *payloadMsgQuote
+	if replyTo != "" {
+		if quote = p.room.quote(replyTo); quote == nil {
+			p.SendData(p.room.makePayload("the message replied to was not found", TypeNotice))
+			return
+		}
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		p.room.hub.log.Printf("error generating message ID: %v", err)
+		return
+	}
+	var expiresAt *time.Time
+	if ttl := p.room.messageLifetime(ttl); ttl > 0 {
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+	b := p.room.makeChatPayload(id, msg, quote, expiresAt, action, p)
+	p.room.broadcast(b, true)
+	p.room.recordHistory(b)
+	if expiresAt != nil {
+		p.room.expireAt(id, *expiresAt, true)
+	}
+	p.room.notifyMentions(p, id, msg)
+}
+
 // processMessage processes incoming messages from peers.
 func (p *Peer) processMessage(b []byte) {
 	var m payloadMsgWrap
@@ -110,27 +226,73 @@ func (p *Peer) processMessage(b []byte) {
 	switch m.Type {
 	// Message to the room.
 	case TypeMessage:
-		// Check rate limits and update counters.
-		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-				p.writeWSControl(websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-				p.ws.Close()
+		if p.rateLimited() {
+			return
+		}
+
+		// A message is either its text or an object with the ID of the
+		// message it replies to and its lifetime in seconds.
+		var (
+			msg, replyTo string
+			ttl          float64
+		)
+		switch d := m.Data.(type) {
+		case string:
+			msg = d
+		case map[string]interface{}:
+			msg, _ = d["message"].(string)
+			replyTo, _ = d["reply_to"].(string)
+			ttl, _ = d["ttl"].(float64)
+		default:
+			// TODO: Respond
+			return
+		}
+		if !p.room.acceptsMessage(msg) {
+			p.SendData(p.room.makePayload("messages must be encrypted in this room", TypeNotice))
+			return
+		}
+
+		// Slash commands. The server can't read the messages of encrypted
+		// rooms, and "//" escapes a message starting with a slash.
+		if !p.room.Encrypted && strings.HasPrefix(msg, "/") {
+			if !strings.HasPrefix(msg, "//") {
+				p.room.hub.runCommand(p, msg)
 				return
 			}
+			msg = msg[1:]
+		}
+		p.room.do(func() {
+			p.postMessage(msg, replyTo, time.Duration(ttl*float64(time.Second)), false)
+		})
+
+	// Edition or deletion of a chat message.
+	case TypeMessageEdit, TypeMessageDelete:
+		if p.rateLimited() {
+			return
 		}
-		p.lastMessage = now
-		p.numMessages++
 
-		msg, ok := m.Data.(string)
+		data, ok := m.Data.(map[string]interface{})
 		if !ok {
 			// TODO: Respond
 			return
 		}
-		p.room.Broadcast(p.room.makeMessagePayload(msg, p, m.Type), true)
+		id, _ := data["id"].(string)
+		msg, _ := data["message"].(string)
+		if id == "" || (m.Type == TypeMessageEdit && msg == "") {
+			return
+		}
+		if m.Type == TypeMessageEdit && !p.room.acceptsMessage(msg) {
+			p.SendData(p.room.makePayload("messages must be encrypted in this room", TypeNotice))
+			return
+		}
+		if m.Type == TypeMessageEdit && p.room.isMuted(p) {
+			p.SendData(p.room.makePayload("you are muted in this room", TypeNotice))
+			return
+		}
+		typ := m.Type
+		p.room.do(func() {
+			p.room.editMessage(p, typ, id, msg)
+		})
 
 	case TypeUploading:
 		data, ok := m.Data.(map[string]interface{})
@@ -138,34 +300,148 @@ func (p *Peer) processMessage(b []byte) {
 			// TODO: Respond
 			return
 		}
-		p.room.Broadcast(p.room.makeUploadPayload(data, p, m.Type), false)
+		p.room.do(func() {
+			if !p.room.muted(p) {
+				p.room.broadcast(p.room.makeUploadPayload(data, p, TypeUploading), false)
+			}
+		})
 
 	case TypeUpload:
-		// Check rate limits and update counters.
-		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-				p.writeWSControl(websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-				p.ws.Close()
+		if p.rateLimited() {
+			return
+		}
+
+		msg, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		p.room.do(func() {
+			if p.room.muted(p) {
+				p.SendData(p.room.makePayload("you are muted in this room", TypeNotice))
 				return
 			}
+			b := p.room.makeUploadPayload(msg, p, TypeUpload)
+			p.room.broadcast(b, true)
+			p.room.recordHistory(b)
+		})
+
+	// Change of the room's topic.
+	case TypeRoomTopic:
+		if p.rateLimited() {
+			return
 		}
-		p.lastMessage = now
-		p.numMessages++
 
-		msg, ok := m.Data.(map[string]interface{})
+		data, ok := m.Data.(map[string]interface{})
 		if !ok {
 			// TODO: Respond
 			return
 		}
-		p.room.Broadcast(p.room.makeUploadPayload(msg, p, m.Type), true)
+		topic, _ := data["topic"].(string)
+		if len(topic) > maxTopicLen {
+			p.SendData(p.room.makePayload("the topic is too long", TypeNotice))
+			return
+		}
+		if topic != "" && !p.room.acceptsMessage(topic) {
+			p.SendData(p.room.makePayload("messages must be encrypted in this room", TypeNotice))
+			return
+		}
+		p.room.do(func() {
+			p.room.setTopic(p, topic)
+		})
+
+	// Pinning of a chat message, or its unpinning.
+	case TypeMessagePin, TypeMessageUnpin:
+		if p.rateLimited() {
+			return
+		}
+
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		id, _ := data["id"].(string)
+		if id == "" {
+			return
+		}
+		typ := m.Type
+		p.room.do(func() {
+			p.room.pin(p, typ, id)
+		})
+
+	// Change of the peer's handle.
+	case TypeHandle:
+		if p.rateLimited() {
+			return
+		}
+
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		handle, _ := data["handle"].(string)
+		p.room.do(func() {
+			p.room.changeHandle(p, handle)
+		})
+
+	// Reaction to a message, or its removal.
+	case TypeReaction:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		if p.rateLimited() {
+			return
+		}
+		id, _ := data["id"].(string)
+		emoji, _ := data["emoji"].(string)
+		if id == "" || p.room.isMuted(p) {
+			return
+		}
+		p.room.do(func() {
+			p.room.react(p, id, emoji)
+		})
+
+	// Read marker.
+	case TypeRead:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		seq, _ := data["seq"].(float64)
+		if seq <= 0 {
+			return
+		}
+		p.room.do(func() {
+			p.room.markRead(p, uint64(seq))
+		})
+
+	// Request for the messages of a thread.
+	case TypeThread:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		id, _ := data["id"].(string)
+		if id == "" {
+			return
+		}
+		p.room.do(func() {
+			p.room.sendThread(p, id)
+		})
 
 	// "Typing" status.
 	case TypeTyping:
-		p.room.Broadcast(p.room.makePeerUpdatePayload(p, TypeTyping), false)
+		p.room.do(func() {
+			if !p.room.muted(p) {
+				p.room.broadcast(p.room.makePeerUpdatePayload(p, TypeTyping), false)
+			}
+		})
 
 	// Request for peers list
 	case TypePeerList:
@@ -178,6 +454,15 @@ func (p *Peer) processMessage(b []byte) {
 			// TODO: Respond
 			return
 		}
+		// Growl notifications carry the message in clear to the notifiers.
+		if p.room.Encrypted {
+			p.SendData(p.room.makePayload("growl is disabled in encrypted rooms", TypeNotice))
+			return
+		}
+		if p.room.isMuted(p) {
+			p.SendData(p.room.makePayload("you are muted in this room", TypeNotice))
+			return
+		}
 		var to string
 		{
 			x, ok := data["to"]
@@ -215,10 +500,55 @@ func (p *Peer) processMessage(b []byte) {
 				to, _ = x.(string)
 			}
 		}
-		p.room.forwardTo(m.Type, to, m.Data)
+		if msg, _ := data["msg"].(string); msg != "" && !p.room.acceptsMessage(msg) {
+			p.SendData(p.room.makePayload("messages must be encrypted in this room", TypeNotice))
+			return
+		}
+		if p.room.isMuted(p) {
+			p.SendData(p.room.makePayload("you are muted in this room", TypeNotice))
+			return
+		}
+		p.room.forwardTo(m.Type, p, to, m.Data)
+
+	// Moderation of a peer.
+	case TypePeerKick, TypePeerBan, TypePeerMute, TypePeerUnmute:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		handle, _ := data["handle"].(string)
+		typ := m.Type
+		p.room.do(func() {
+			p.room.moderate(p, typ, handle)
+		})
+
+	// Promotion to moderator, or demotion.
+	case TypePeerPromote, TypePeerDemote:
+		data, ok := m.Data.(map[string]interface{})
+		if !ok {
+			// TODO: Respond
+			return
+		}
+		handle, _ := data["handle"].(string)
+		role := RoleModerator
+		if m.Type == TypePeerDemote {
+			role = RolePeer
+		}
+		p.room.do(func() {
+			p.room.setRole(p, handle, role)
+		})
 
 	// Dipose of a room.
 	case TypeRoomDispose:
+		var owner bool
+		p.room.do(func() {
+			owner = p.Role == RoleOwner
+		})
+		if !owner {
+			p.SendData(p.room.makePayload("only the room owners can dispose of it", TypeNotice))
+			return
+		}
 		p.room.Dispose()
 	default:
 	}
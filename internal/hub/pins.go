@@ -0,0 +1,193 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/knadh/niltalk/store"
+)
+
+const (
+	// Maximum number of pinned messages of a room.
+	maxPins = 10
+
+	// Maximum length in bytes of a room's topic.
+	maxTopicLen = 1000
+)
+
+// payloadTopic announces the room's topic.
+type payloadTopic struct {
+	Topic    string `json:"topic"`
+	ByHandle string `json:"by_handle,omitempty"`
+}
+
+// payloadPins lists the room's pinned chat messages, in the order they were
+// pinned.
+type payloadPins struct {
+	Messages []json.RawMessage `json:"messages"`
+	ByHandle string            `json:"by_handle,omitempty"`
+}
+
+// canEditRoom tells if a peer is allowed to change the room's topic and pins.
+func canEditRoom(p *Peer) bool {
+	return roleRanks[p.Role] >= roleRanks[RoleModerator]
+}
+
+// setTopic changes the room's topic on behalf of a moderator and announces
+// it. It must be called from the room's goroutine.
+func (r *Room) setTopic(from *Peer, topic string) {
+	if !canEditRoom(from) {
+		from.SendData(r.makePayload("only the moderators can change the topic", TypeNotice))
+		return
+	}
+
+	r.topic = topic
+	r.saveMeta()
+	b := r.makePayload(payloadTopic{Topic: topic, ByHandle: from.Handle}, TypeRoomTopic)
+	r.fanout(b)
+	r.publish(clusterEvent{Type: clusterTopic, Payload: b})
+}
+
+// pin pins or unpins a chat message on behalf of a moderator and announces
+// the room's pins. It must be called from the room's goroutine.
+func (r *Room) pin(from *Peer, typ, id string) {
+	if !canEditRoom(from) {
+		from.SendData(r.makePayload("only the moderators can pin messages", TypeNotice))
+		return
+	}
+
+	if typ == TypeMessageUnpin {
+		if !r.unpin(id) {
+			return
+		}
+	} else {
+		if r.pinIndex(id) >= 0 {
+			return
+		}
+		if len(r.pins) >= maxPins {
+			from.SendData(r.makePayload("too many pinned messages", TypeNotice))
+			return
+		}
+		b, m, ok := r.findMessage(id)
+		if !ok || m.Data.(*payloadMsgChat).Deleted {
+			from.SendData(r.makePayload("message not found", TypeNotice))
+			return
+		}
+		r.pins = append(r.pins, b)
+	}
+	r.pinsChanged(from.Handle)
+}
+
+// updatePin replaces the pinned copy of an edited chat message, or unpins it
+// if it was deleted.
+func (r *Room) updatePin(b []byte, byHandle string) {
+	m, ok := decodeMessage(b)
+	if !ok {
+		return
+	}
+	c := m.Data.(*payloadMsgChat)
+	i := r.pinIndex(c.ID)
+	if i < 0 {
+		return
+	}
+	if c.Deleted {
+		r.unpin(c.ID)
+	} else {
+		r.pins[i] = b
+	}
+	r.pinsChanged(byHandle)
+}
+
+// pinsChanged stores the room's pins and announces them.
+func (r *Room) pinsChanged(byHandle string) {
+	r.saveMeta()
+	b := r.makePinsPayload(byHandle)
+	r.fanout(b)
+	r.publish(clusterEvent{Type: clusterPins, Payload: b})
+}
+
+// unpin removes a chat message from the room's pins. It tells if it was
+// pinned.
+func (r *Room) unpin(id string) bool {
+	i := r.pinIndex(id)
+	if i < 0 {
+		return false
+	}
+	r.pins = append(r.pins[:i:i], r.pins[i+1:]...)
+	return true
+}
+
+// pinIndex returns the index of a chat message in the room's pins, or -1.
+func (r *Room) pinIndex(id string) int {
+	for i, b := range r.pins {
+		if m, ok := decodeMessage(b); ok && m.Data.(*payloadMsgChat).ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// makePinsPayload prepares a payload with the room's pinned messages.
+func (r *Room) makePinsPayload(byHandle string) []byte {
+	msgs := make([]json.RawMessage, 0, len(r.pins))
+	for _, b := range r.pins {
+		msgs = append(msgs, b)
+	}
+	return r.makePayload(payloadPins{Messages: msgs, ByHandle: byHandle}, TypePins)
+}
+
+// sendMeta sends the peer the room's topic and pinned messages.
+func (r *Room) sendMeta(p *Peer) {
+	if r.topic != "" {
+		p.SendData(r.makePayload(payloadTopic{Topic: r.topic}, TypeRoomTopic))
+	}
+	if len(r.pins) > 0 {
+		p.SendData(r.makePinsPayload(""))
+	}
+}
+
+// saveMeta stores the room's topic and pins with the room.
+func (r *Room) saveMeta() {
+	sr, err := r.hub.Store.GetRoom(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading room %s: %v", r.ID, err)
+		return
+	}
+	sr.Topic = r.topic
+	sr.Pins = r.pins
+	if err := r.hub.Store.UpdateRoom(sr); err != nil {
+		r.hub.log.Printf("error updating room %s in the store: %v", r.ID, err)
+	}
+}
+
+// processClusterMeta records the topic or the pins set through another
+// instance and broadcasts them.
+func (r *Room) processClusterMeta(typ string, b []byte) {
+	if typ == clusterTopic {
+		m := payloadMsgWrap{Data: &payloadTopic{}}
+		if err := json.Unmarshal(b, &m); err != nil {
+			r.hub.log.Printf("error decoding topic: %v", err)
+			return
+		}
+		r.topic = m.Data.(*payloadTopic).Topic
+	} else {
+		m := payloadMsgWrap{Data: &payloadPins{}}
+		if err := json.Unmarshal(b, &m); err != nil {
+			r.hub.log.Printf("error decoding pins: %v", err)
+			return
+		}
+		r.pins = r.pins[:0:0]
+		for _, p := range m.Data.(*payloadPins).Messages {
+			r.pins = append(r.pins, p)
+		}
+	}
+	r.fanout(b)
+}
+
+// keepMeta carries the topic and pins of a room already in the store over
+// to the given one, which is about to replace it.
+func keepMeta(sr *store.Room, s store.Store) {
+	if old, err := s.GetRoom(sr.ID); err == nil {
+		sr.Topic = old.Topic
+		sr.Pins = old.Pins
+	}
+}
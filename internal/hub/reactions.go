@@ -0,0 +1,143 @@
+package hub
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum number of characters of a reaction.
+	maxReactionLen = 8
+	// Maximum number of different reactions to a message.
+	maxMessageReactions = 20
+	// Maximum number of messages whose reactions are kept, the oldest ones
+	// are forgotten first.
+	maxReactedMessages = 1000
+)
+
+// payloadReaction is a change of the reactions to a message.
+type payloadReaction struct {
+	ID         string `json:"id"`
+	Emoji      string `json:"emoji"`
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	Removed    bool   `json:"removed,omitempty"`
+}
+
+// reactions are the reactions to the messages of a room by message ID, then
+// by emoji, with the IDs of the peers who reacted.
+type reactions struct {
+	byMessage map[string]map[string][]string
+	// Message IDs, oldest first.
+	order []string
+}
+
+func newReactions() *reactions {
+	return &reactions{byMessage: make(map[string]map[string][]string)}
+}
+
+// react adds or removes the reaction of a peer to a message on its behalf,
+// and broadcasts the change. Reacting again with the same emoji removes the
+// reaction. It must be called from the room's goroutine.
+func (r *Room) react(from *Peer, id, emoji string) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionLen {
+		return
+	}
+
+	msg, known := r.reactions.byMessage[id]
+	if !known {
+		if _, m, ok := r.findMessage(id); !ok || m.Data.(*payloadMsgChat).Deleted {
+			from.SendData(r.makePayload("message not found", TypeNotice))
+			return
+		}
+	}
+	if _, ok := msg[emoji]; !ok && len(msg) >= maxMessageReactions {
+		from.SendData(r.makePayload("too many reactions to this message", TypeNotice))
+		return
+	}
+
+	d := payloadReaction{ID: id, Emoji: emoji, PeerID: from.ID, PeerHandle: from.Handle}
+	for _, p := range msg[emoji] {
+		if p == from.ID {
+			d.Removed = true
+			break
+		}
+	}
+
+	b := r.makePayload(d, TypeReaction)
+	r.applyReaction(d)
+	r.fanout(b)
+	r.publish(clusterEvent{Type: clusterReaction, Payload: b})
+}
+
+// applyReaction applies a change of the reactions to a message.
+func (r *Room) applyReaction(d payloadReaction) {
+	rs := r.reactions
+	msg, ok := rs.byMessage[d.ID]
+	if !ok {
+		if d.Removed {
+			return
+		}
+		msg = make(map[string][]string)
+		rs.byMessage[d.ID] = msg
+		rs.order = append(rs.order, d.ID)
+		if len(rs.order) > maxReactedMessages {
+			delete(rs.byMessage, rs.order[0])
+			rs.order = rs.order[1:]
+		}
+	}
+
+	peers := msg[d.Emoji]
+	for i, p := range peers {
+		if p == d.PeerID {
+			peers = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	if !d.Removed {
+		peers = append(peers, d.PeerID)
+	}
+
+	if len(peers) == 0 {
+		delete(msg, d.Emoji)
+	} else {
+		msg[d.Emoji] = peers
+	}
+}
+
+// clearReactions forgets the reactions to a message.
+func (r *Room) clearReactions(id string) {
+	rs := r.reactions
+	if _, ok := rs.byMessage[id]; !ok {
+		return
+	}
+	delete(rs.byMessage, id)
+	for i, o := range rs.order {
+		if o == id {
+			rs.order = append(rs.order[:i], rs.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// sendReactions sends the peer the current reactions to the room's messages.
+func (r *Room) sendReactions(p *Peer) {
+	if len(r.reactions.byMessage) == 0 {
+		return
+	}
+	p.SendData(r.makePayload(r.reactions.byMessage, TypeReactions))
+}
+
+// processClusterReaction applies a change of reactions made on another
+// instance and broadcasts it.
+func (r *Room) processClusterReaction(b []byte) {
+	m := payloadMsgWrap{Data: &payloadReaction{}}
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.hub.log.Printf("error decoding reaction: %v", err)
+		return
+	}
+	r.applyReaction(*m.Data.(*payloadReaction))
+	r.fanout(b)
+}
@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// payloadDelivery acknowledges the delivery of a whisper or a ping to its
+// sender, or tells why it failed.
+type payloadDelivery struct {
+	To   string `json:"to"`
+	Type string `json:"type"`
+	// Reference given by the sender to match the acknowledgement.
+	Ref string `json:"ref,omitempty"`
+	// The recipient is offline and will receive it at their next login.
+	Queued bool   `json:"queued,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// payloadRead marks the sequence ID of the last payload a peer has read.
+type payloadRead struct {
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	Seq        uint64 `json:"seq"`
+}
+
+// forward sends a whisper or a ping to its recipient and acknowledges it to
+// the sender. A recipient connected to another instance is reached through
+// the bus, and that instance acknowledges the delivery. A whisper to an
+// offline predefined user is queued in their mailbox if the room has one. It
+// must be called from the room's goroutine.
+func (r *Room) forward(fw forwardReq) {
+	d := payloadDelivery{To: fw.to, Type: fw.reqType, Ref: forwardRef(fw.data)}
+
+	if p := r.peerByHandle(fw.to); p != nil {
+		p.SendData(r.makeForwardPayload(fw.data, fw.from.msgPeer(), fw.reqType))
+		fw.from.SendData(r.makePayload(d, TypeDelivered))
+		return
+	}
+
+	for _, p := range r.remotePeers {
+		if p.Handle == fw.to {
+			r.publish(clusterEvent{Type: clusterForward, ReqType: fw.reqType, To: fw.to, Data: fw.data,
+				Peer: fw.from.msgPeer()})
+			return
+		}
+	}
+
+	if r.queueMail(fw) {
+		d.Queued = true
+		fw.from.SendData(r.makePayload(d, TypeDelivered))
+		return
+	}
+
+	d.Error = "recipient is offline"
+	fw.from.SendData(r.makePayload(d, TypeUndelivered))
+}
+
+// makeForwardPayload prepares a whisper or a ping payload from its sender.
+func (r *Room) makeForwardPayload(data interface{}, from *payloadMsgPeer, typ string) []byte {
+	d := payloadUpload{
+		PeerID:     from.ID,
+		PeerHandle: from.Handle,
+		Data:       data,
+	}
+	return r.makePayload(d, typ)
+}
+
+// forwardRef returns the sender's reference of a forwarded payload.
+func forwardRef(data interface{}) string {
+	m, _ := data.(map[string]interface{})
+	ref, _ := m["ref"].(string)
+	return ref
+}
+
+// peerByID returns the local peer with the given ID.
+func (r *Room) peerByID(id string) *Peer {
+	for p := range r.peers {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// markRead records the sequence ID of the last payload a peer has read and
+// broadcasts it. Markers only move forward. It must be called from the
+// room's goroutine.
+func (r *Room) markRead(from *Peer, seq uint64) {
+	if seq <= r.readMarks[from.ID].Seq || seq > atomic.LoadUint64(&r.seq) {
+		return
+	}
+
+	d := payloadRead{PeerID: from.ID, PeerHandle: from.Handle, Seq: seq}
+	r.readMarks[from.ID] = d
+	b := r.makePayload(d, TypeRead)
+	r.fanout(b)
+	r.publish(clusterEvent{Type: clusterRead, Payload: b})
+}
+
+// sendReadMarks sends the peer the read markers of the room's peers.
+func (r *Room) sendReadMarks(p *Peer) {
+	if len(r.readMarks) == 0 {
+		return
+	}
+	out := make([]payloadRead, 0, len(r.readMarks))
+	for _, m := range r.readMarks {
+		out = append(out, m)
+	}
+	p.SendData(r.makePayload(out, TypeReadList))
+}
+
+// processClusterRead records a read marker of a peer connected to another
+// instance and broadcasts it.
+func (r *Room) processClusterRead(b []byte) {
+	m := payloadMsgWrap{Data: &payloadRead{}}
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.hub.log.Printf("error decoding read marker: %v", err)
+		return
+	}
+	d := *m.Data.(*payloadRead)
+	r.readMarks[d.PeerID] = d
+	r.fanout(b)
+}
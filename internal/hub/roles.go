@@ -0,0 +1,128 @@
+package hub
+
+// Roles of the peers in a room.
+const (
+	RolePeer      = ""
+	RoleModerator = "moderator"
+	RoleOwner     = "owner"
+)
+
+// roleRanks orders the roles by privileges.
+var roleRanks = map[string]int{
+	RolePeer:      0,
+	RoleModerator: 1,
+	RoleOwner:     2,
+}
+
+// loginRole returns the role of a peer logging in with the given handle and
+// owner key. The handle's password must have been checked already. It must
+// not be called from the room's goroutine.
+func (r *Room) loginRole(handle, ownerKey string) string {
+	var admin bool
+	r.do(func() {
+		admin = r.isAdmin(handle)
+	})
+	if admin || (ownerKey != "" && r.checkOwnerKey(ownerKey)) {
+		return RoleOwner
+	}
+	return RolePeer
+}
+
+// isAdmin tells if the handle is one of the room's admins. Admins must be
+// predefined users, otherwise anyone could claim their handles. It must be
+// called from the room's goroutine.
+func (r *Room) isAdmin(handle string) bool {
+	for _, a := range r.admins {
+		if a == handle {
+			return r.isPredefinedUser(handle)
+		}
+	}
+	return false
+}
+
+// roleOf returns the role of the peer with the given handle, connected to this
+// instance or to another one.
+func (r *Room) roleOf(handle string) string {
+	if p := r.peerByHandle(handle); p != nil {
+		return p.Role
+	}
+	for _, p := range r.remotePeers {
+		if p.Handle == handle {
+			return p.Role
+		}
+	}
+	return RolePeer
+}
+
+// roleByID returns the role of the peer with the given ID, connected to this
+// instance or to another one, or leaving.
+func (r *Room) roleByID(id string) string {
+	if p := r.peerByID(id); p != nil {
+		return p.Role
+	}
+	if l, ok := r.leaving[id]; ok {
+		return l.peer.Role
+	}
+	if p, ok := r.remotePeers[id]; ok {
+		return p.Role
+	}
+	return RolePeer
+}
+
+// canModerate tells if a peer is allowed to moderate the peer with the given
+// handle.
+func (r *Room) canModerate(p *Peer, handle string) bool {
+	return r.outranks(p, r.roleOf(handle))
+}
+
+// outranks tells if a peer is allowed to moderate the peers with the given
+// role. Moderators and owners can act on peers of lower ranks.
+func (r *Room) outranks(p *Peer, role string) bool {
+	return roleRanks[p.Role] >= roleRanks[RoleModerator] &&
+		roleRanks[p.Role] > roleRanks[role]
+}
+
+// setRole changes the role of a peer on behalf of an owner and announces it to
+// the room. It must be called from the room's goroutine.
+func (r *Room) setRole(from *Peer, handle, role string) {
+	if from.Role != RoleOwner {
+		from.SendData(r.makePayload("only the room owners can change roles", TypeNotice))
+		return
+	}
+	if handle == "" || handle == from.Handle {
+		return
+	}
+	if r.roleOf(handle) == RoleOwner {
+		from.SendData(r.makePayload("the role of an owner can't be changed", TypeNotice))
+		return
+	}
+
+	r.applyRole(handle, role)
+	r.publish(clusterEvent{Type: clusterRole, ReqType: role, To: handle})
+	r.hub.log.Printf("%s@%s: %s is now %q in %s", from.Handle, from.ID, handle, role, r.ID)
+}
+
+// applyRole changes the role of the peer with the given handle, in the store
+// and in the room, and broadcasts it. Owners keep their role. It must be
+// called from the room's goroutine.
+func (r *Room) applyRole(handle, role string) {
+	if r.roleOf(handle) == RoleOwner {
+		return
+	}
+	for id, p := range r.remotePeers {
+		if p.Handle == handle {
+			p.Role = role
+			r.remotePeers[id] = p
+		}
+	}
+
+	p := r.peerByHandle(handle)
+	if p == nil {
+		return
+	}
+	p.Role = role
+	if err := r.hub.Store.AddSession(p.ID, p.Handle, role, r.ID, r.hub.Config().RoomAge); err != nil {
+		r.hub.log.Printf("error updating session role: %v", err)
+	}
+	r.broadcast(r.makePeerUpdatePayload(p, TypePeerRole), true)
+}
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,6 +12,7 @@ import (
 )
 
 type payloadMsgWrap struct {
+	Seq       uint64      `json:"seq,omitempty"`
 	Type      string      `json:"type"`
 	Timestamp time.Time   `json:"timestamp"`
 	Data      interface{} `json:"data"`
@@ -20,12 +21,25 @@ type payloadMsgWrap struct {
 type payloadMsgPeer struct {
 	ID     string `json:"id"`
 	Handle string `json:"handle"`
+	Role   string `json:"role"`
+	// Public key announced by the peer in an encrypted room.
+	Key string `json:"key,omitempty"`
 }
 
 type payloadMsgChat struct {
+	// ID of the message, set on the messages that can be edited.
+	ID         string `json:"id,omitempty"`
 	PeerID     string `json:"peer_id"`
 	PeerHandle string `json:"peer_handle"`
 	Msg        string `json:"message"`
+	Edited     bool   `json:"edited,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	// The message is an action of the peer, sent with /me.
+	Action bool `json:"action,omitempty"`
+	// End of the message's lifetime, after which it's removed.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// The message replied to.
+	ReplyTo *payloadMsgQuote `json:"reply_to,omitempty"`
 }
 
 type payloadUpload struct {
@@ -34,6 +48,11 @@ type payloadUpload struct {
 	Data       interface{} `json:"data"`
 }
 
+type payloadRestart struct {
+	// Milliseconds after which to reconnect.
+	ReconnectIn int64 `json:"reconnect_in"`
+}
+
 // peerReq represents a peer request (join, leave etc.) that's processed
 // by a Room.
 type peerReq struct {
@@ -41,34 +60,72 @@ type peerReq struct {
 	peer    *Peer
 }
 
+// leavingPeer is a peer that lost its connection.
+type leavingPeer struct {
+	peer *Peer
+	at   time.Time
+}
+
 // forwardReq represents a message forwarding from a peer to another peer.
 type forwardReq struct {
 	reqType string
+	from    *Peer
 	to      string
 	data    interface{}
 }
 
+// GrowlFunc notifies an offline predefined user that a peer is calling them.
+// token creates an autologin token for the notification, it's only called
+// once the notification is about to be sent and returns an empty string on
+// error.
+type GrowlFunc func(to, from, msg string, token func() string)
+
 // Room represents a chat room.
 type Room struct {
+	// Accessed atomically, first to be 64-bit aligned on 32-bit platforms.
+	// Sequence ID of the last payload.
+	seq uint64
+	// Time of the last broadcast, in Unix nanoseconds.
+	lastActivity int64
+	// Number of local peers.
+	numPeers int32
+
 	ID              string
 	Name            string
 	Password        []byte
 	Predefined      bool
 	PredefinedUsers []PredefinedUser
 
-	hub *Hub
+	// The room only relays the ciphertexts of its peers' messages, which
+	// are encrypted with a key the server never sees.
+	Encrypted bool
+
+	// Hash of the key given to the creator of the room, that makes it
+	// an owner when logging in.
+	ownerKey []byte
+
+	// Predefined users that are owners of the room.
+	admins []string
 
-	lastActivity time.Time
+	hub *Hub
 
 	// List of connected peers.
 	peers map[*Peer]bool
 
-	// Broadcast channel for messages.
-	broadcastQ chan []byte
+	// Peers that lost their connection, by session ID, with the time they
+	// did. They're still present in the room during the reconnect grace
+	// period.
+	leaving     map[string]leavingPeer
+	leavingTick <-chan time.Time
+
+	// Peers connected to the other instances serving the room in
+	// cluster mode, by ID.
+	remotePeers map[string]payloadMsgPeer
+	clusterQ    <-chan []byte
+	unsubscribe func()
 
 	// GrowlHandler is an async callback fired when a peer notifies an offline predefined users.
-	GrowlHandler func(msg, handle, token string)
-	growlTokens  *tokenStore
+	GrowlHandler GrowlFunc
 
 	// Peer related requests.
 	peerQ    chan peerReq
@@ -76,17 +133,51 @@ type Room struct {
 
 	// Dispose signal.
 	disposeSig chan bool
+	disposed   bool
 	closed     bool
 
+	// The room was unloaded to make space for another one or because the
+	// server is shutting down. done is closed once the room has stopped.
+	unloaded bool
+	done     chan struct{}
+
+	// Moderation, for the room's lifetime.
+	bannedHandles  map[string]bool
+	bannedSessions map[string]bool
+	mutedHandles   map[string]bool
+	mutedSessions  map[string]bool
+
 	op chan func()
 
 	// Message / payload cache.
 	payloadCache [][]byte
 
+	// Reactions to the messages, for the room's lifetime.
+	reactions *reactions
+
+	// Read markers of the peers, by peer ID.
+	readMarks map[string]payloadRead
+
 	timestamp time.Time
 
 	// Message Of The Day
 	motd string
+
+	// Persistent history of chat and upload payloads.
+	history HistoryOptions
+
+	// Whispers queued for the predefined users while they are offline.
+	mailbox MailboxOptions
+
+	// Topic set by the moderators, and the pinned chat messages.
+	topic string
+	pins  [][]byte
+
+	// Lifetime of the chat messages, and the expiry of the messages that
+	// have one, by ID.
+	messageTTL time.Duration
+	expiring   map[string]expiry
+	expiryTick <-chan time.Time
 }
 
 // NewRoom returns a new instance of Room.
@@ -97,46 +188,59 @@ func NewRoom(id, name string, password []byte, h *Hub, predefined bool) *Room {
 		Password:     password,
 		Predefined:   predefined,
 		hub:          h,
+		lastActivity: time.Now().UnixNano(),
 		peers:        make(map[*Peer]bool, 100),
-		broadcastQ:   make(chan []byte, 100),
+		remotePeers:  make(map[string]payloadMsgPeer),
+		leaving:      make(map[string]leavingPeer),
 		peerQ:        make(chan peerReq, 100),
 		forwardQ:     make(chan forwardReq, 100),
 		disposeSig:   make(chan bool),
-		payloadCache: make([][]byte, 0, h.cfg.MaxCachedMessages),
-		growlTokens:  newTokenStore(),
+		done:         make(chan struct{}),
+		payloadCache: make([][]byte, 0, h.Config().MaxCachedMessages),
+		reactions:    newReactions(),
+		readMarks:    make(map[string]payloadRead),
+		expiring:     make(map[string]expiry),
 		op:           make(chan func()),
+
+		bannedHandles:  make(map[string]bool),
+		bannedSessions: make(map[string]bool),
+		mutedHandles:   make(map[string]bool),
+		mutedSessions:  make(map[string]bool),
 	}
 }
 
 // Login an user into the room. It chekcs for room password,
 // user password is the handle belongs to a predefined user.
+// The owner key, if any, is checked to grant the owner role.
 // Generates a session ID and stores it into the store.
-func (r *Room) Login(roomPwd, handle, handlePwd string, roomAge time.Duration) (string, error) {
-	if err := bcrypt.CompareHashAndPassword(r.Password, []byte(roomPwd)); err != nil {
+func (r *Room) Login(roomPwd, handle, handlePwd, ownerKey string, roomAge time.Duration) (string, error) {
+	if r.hub.Closing() {
+		return "", ErrShuttingDown
+	}
+	// The password and the users are reconfigured on the room's goroutine,
+	// the hashes are compared outside of it.
+	var (
+		pwd   []byte
+		users []PredefinedUser
+	)
+	r.do(func() {
+		pwd, users = r.Password, r.PredefinedUsers
+	})
+	if err := bcrypt.CompareHashAndPassword(pwd, []byte(roomPwd)); err != nil {
 		return "", ErrInvalidRoomPassword
 	}
 
-	for _, u := range r.PredefinedUsers {
-		if u.Name == handle && u.Password != handlePwd {
+	for _, u := range users {
+		if u.Name == handle && !checkUserPassword(u.Password, handlePwd) {
 			return "", ErrInvalidUserPassword
 		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	var connected bool
-	r.op <- func() {
-		for p := range r.peers {
-			if p.Handle == handle {
-				connected = true
-				break
-			}
-		}
-		wg.Done()
+	if r.isBanned(handle) {
+		return "", ErrBanned
 	}
-	wg.Wait()
 
-	if connected {
+	if r.isConnected(handle) {
 		return "", ErrAlreadyConnected
 	}
 
@@ -147,7 +251,7 @@ func (r *Room) Login(roomPwd, handle, handlePwd string, roomAge time.Duration) (
 		return "", errors.New("error generating session ID")
 	}
 
-	if err := r.hub.Store.AddSession(sessID, handle, r.ID, roomAge); err != nil {
+	if err := r.hub.Store.AddSession(sessID, handle, r.loginRole(handle, ownerKey), r.ID, roomAge); err != nil {
 		r.hub.log.Printf("error creating session: %v", err)
 		return "", errors.New("error storing session")
 	}
@@ -161,10 +265,30 @@ var (
 	ErrInvalidUserPassword = fmt.Errorf("invalid user password")
 	ErrAlreadyConnected    = fmt.Errorf("user is already connected")
 	ErrInvalidToken        = fmt.Errorf("invalid autologin token")
+	ErrBanned              = fmt.Errorf("you are banned from this room")
 )
 
+// SetPredefinedUsers sets the predefined users of the room and the handler
+// of their growl notifications.
+func (r *Room) SetPredefinedUsers(users []PredefinedUser, growl GrowlFunc) {
+	users = append([]PredefinedUser(nil), users...)
+	r.do(func() {
+		r.PredefinedUsers = users
+		r.GrowlHandler = growl
+	})
+}
+
 // HandleGrowlNotifications sends growl notification if target user is offline.
 func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
+	r.do(func() {
+		r.growl(fromPeer, to, msg)
+	})
+}
+
+// growl sends a growl notification to a predefined user if they are offline.
+// The autologin token is only created if the notification isn't rate limited.
+// It must be called from the room's goroutine.
+func (r *Room) growl(fromPeer, to, msg string) {
 	if r.GrowlHandler == nil {
 		return
 	}
@@ -179,43 +303,47 @@ func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
 		return
 	}
 
-	r.op <- func() {
-		// check if user is online
-		for p := range r.peers {
-			if p.Handle == to {
-				return
-			}
+	// check if user is online
+	for p := range r.peers {
+		if p.Handle == to {
+			return
+		}
+	}
+	for _, p := range r.remotePeers {
+		if p.Handle == to {
+			return
 		}
-		// user is offline, generate a login token, send the notification
-		tok := r.growlTokens.getOrCreateToken(to)
-		go r.GrowlHandler(msg, fromPeer, tok)
 	}
+
+	// user is offline, send the notification
+	go r.GrowlHandler(to, fromPeer, msg, func() string {
+		tok, err := r.newLoginToken(to)
+		if err != nil {
+			return ""
+		}
+		return tok
+	})
 }
 
 // LoginWithToken allows for automatic login using a temporary token.
 func (r *Room) LoginWithToken(token string, roomAge time.Duration) (string, error) {
+	if r.hub.Closing() {
+		return "", ErrShuttingDown
+	}
 
-	handle := r.growlTokens.checkToken(token)
-
+	handle, err := r.checkToken(token)
+	if err != nil {
+		return "", err
+	}
 	if len(handle) < 1 {
 		return "", ErrInvalidToken
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	var connected bool
-	r.op <- func() {
-		for p := range r.peers {
-			if p.Handle == handle {
-				connected = true
-				break
-			}
-		}
-		wg.Done()
+	if r.isBanned(handle) {
+		return "", ErrBanned
 	}
-	wg.Wait()
 
-	if connected {
+	if r.isConnected(handle) {
 		return "", ErrAlreadyConnected
 	}
 
@@ -226,7 +354,7 @@ func (r *Room) LoginWithToken(token string, roomAge time.Duration) (string, erro
 		return "", errors.New("error generating session ID")
 	}
 
-	if err := r.hub.Store.AddSession(sessID, handle, r.ID, roomAge); err != nil {
+	if err := r.hub.Store.AddSession(sessID, handle, r.loginRole(handle, ""), r.ID, roomAge); err != nil {
 		r.hub.log.Printf("error creating session: %v", err)
 		return "", errors.New("error storing session")
 	}
@@ -234,24 +362,106 @@ func (r *Room) LoginWithToken(token string, roomAge time.Duration) (string, erro
 	return sessID, nil
 }
 
+// configure applies the options of a predefined room.
+func (r *Room) configure(pr PredefinedRoom) {
+	r.motd = pr.Motd
+	r.admins = pr.Admins
+	r.history = pr.History
+	if r.history.MaxMessages == 0 {
+		r.history.MaxMessages = r.hub.Config().MaxCachedMessages
+	}
+	r.messageTTL = pr.MessageTTL
+	r.mailbox = pr.Mailbox
+	if r.mailbox.MaxMessages == 0 {
+		r.mailbox.MaxMessages = r.hub.Config().MaxCachedMessages
+	}
+}
+
+// checkOwnerKey tells if the given key is the room's owner key.
+func (r *Room) checkOwnerKey(key string) bool {
+	if len(r.ownerKey) == 0 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(r.ownerKey, []byte(key)) == nil
+}
+
+// isConnected tells if a peer with the given handle is connected to the room,
+// on this instance or on another one.
+func (r *Room) isConnected(handle string) bool {
+	var connected bool
+	r.do(func() {
+		connected = r.handleTaken(handle)
+	})
+	return connected
+}
+
+// peerByHandle returns the local peer with the given handle, if any.
+func (r *Room) peerByHandle(handle string) *Peer {
+	for p := range r.peers {
+		if p.Handle == handle {
+			return p
+		}
+	}
+	return nil
+}
+
 // AddPeer adds a new peer to the room given a WS connection from an HTTP
-// handler.
-func (r *Room) AddPeer(id, handle string, ws *websocket.Conn) {
-	r.queuePeerReq(TypePeerJoin, newPeer(id, handle, ws, r))
+// handler. A reconnecting peer gives the sequence ID of the last payload it
+// received to only get the ones it missed.
+func (r *Room) AddPeer(id, handle, role, key string, since uint64, ws *websocket.Conn) {
+	p := newPeer(id, handle, role, ws, r)
+	p.since = since
+	if r.Encrypted {
+		p.Key = key
+	}
+	r.queuePeerReq(TypePeerJoin, p)
 }
 
 // Dispose signals the room to notify all connected peer messages, and dispose
 // of itself.
 func (r *Room) Dispose() {
-	r.disposeSig <- true
+	select {
+	case r.disposeSig <- true:
+	case <-r.done:
+	}
 }
 
-// Broadcast broadcasts a message to all connected peers.
+// Broadcast broadcasts a message to all connected peers, including the ones
+// connected to other instances in cluster mode. It must not be called from
+// the room's goroutine, which uses broadcast.
 func (r *Room) Broadcast(data []byte, record bool) {
-	r.broadcastQ <- data
+	r.do(func() {
+		r.broadcast(data, record)
+	})
+}
+
+// broadcast broadcasts a message to all connected peers, including the ones
+// connected to other instances in cluster mode. It must be called from the
+// room's goroutine.
+func (r *Room) broadcast(data []byte, record bool) {
+	r.fanout(data)
 	if record {
 		r.recordMsgPayload(data)
 	}
+	r.publish(clusterEvent{Type: clusterBroadcast, Payload: data, Record: record})
+}
+
+// fanout sends a message to the peers connected to this instance. It must be
+// called from the room's goroutine.
+func (r *Room) fanout(data []byte) {
+	for p := range r.peers {
+		p.SendData(data)
+	}
+	metricBroadcasts.Inc()
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+
+	// Extend the room's expiry (once every 30 seconds).
+	if !r.Predefined {
+		if time.Since(r.timestamp) > time.Duration(30)*time.Second {
+			r.timestamp = time.Now()
+			r.extendTTL()
+		}
+	}
 }
 
 // run is a blocking function that starts the main event loop for a room that
@@ -263,6 +473,9 @@ loop:
 		select {
 		case op := <-r.op:
 			op()
+			if r.unloaded {
+				break loop
+			}
 
 		// Dispose request.
 		case <-r.disposeSig:
@@ -270,25 +483,27 @@ loop:
 				continue
 			}
 			r.hub.Store.ClearSessions(r.ID)
+			r.hub.Store.ClearHistory(r.ID)
+			r.publish(clusterEvent{Type: clusterDispose})
+			r.disposed = true
 			break loop
 
-		case fw, ok := <-r.forwardQ:
+		// Event from another instance serving the room.
+		case b, ok := <-r.clusterQ:
 			if !ok {
-				break loop
+				r.clusterQ = nil
+				continue
 			}
-			var toPeer *Peer
-			for p := range r.peers {
-				if p.Handle == fw.to {
-					toPeer = p
-					break
-				}
+			if r.processClusterEvent(b) {
+				r.disposed = true
+				break loop
 			}
 
-			if toPeer == nil {
-				continue
+		case fw, ok := <-r.forwardQ:
+			if !ok {
+				break loop
 			}
-
-			toPeer.SendData(r.makeUploadPayload(fw.data, toPeer, fw.reqType))
+			r.forward(fw)
 
 		// Incoming peer request.
 		case req, ok := <-r.peerQ:
@@ -299,8 +514,19 @@ loop:
 			switch req.reqType {
 			// A new peer has joined.
 			case TypePeerJoin:
+				// The peer reconnected during the grace period, or before
+				// its old connection was dropped, which is closed in favour
+				// of the new one.
+				_, resumed := r.leaving[req.peer.ID]
+				delete(r.leaving, req.peer.ID)
+				if stale := r.peerByID(req.peer.ID); stale != nil {
+					resumed = true
+					r.removePeer(stale)
+					stale.ws.Close()
+				}
+
 				// Room's capacity is exchausted. Kick the peer out.
-				if len(r.peers) >= r.hub.cfg.MaxPeersPerRoom {
+				if len(r.peers)+len(r.remotePeers)+len(r.leaving) >= r.hub.Config().MaxPeersPerRoom {
 					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
 					req.peer.writeWSControl(websocket.CloseMessage,
 						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomFull))
@@ -308,69 +534,192 @@ loop:
 					continue
 				}
 
+				// The peer was banned while it was disconnected.
+				if r.bannedHandles[req.peer.Handle] || r.bannedSessions[req.peer.ID] {
+					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
+					req.peer.writeWSControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerBanned))
+					req.peer.ws.Close()
+					continue
+				}
+
 				r.peers[req.peer] = true
+				atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
 				go req.peer.RunListener()
 				go req.peer.RunWriter()
 
 				// Send the peer its info.
 				req.peer.SendData(r.makePeerUpdatePayload(req.peer, TypePeerInfo))
-
-				// Send the peer last N message.
-				if r.hub.cfg.MaxCachedMessages > 0 {
+				r.sendMeta(req.peer)
+
+				// Send the peer last N message, from the persistent history
+				// if the room has one, or the ones it missed if it's
+				// reconnecting. A cursor ahead of the room is from before
+				// a restart and is ignored.
+				since := req.peer.since
+				if since > atomic.LoadUint64(&r.seq) {
+					since = 0
+				}
+				if r.history.Enabled {
+					r.sendHistory(req.peer, since)
+				} else if r.hub.Config().MaxCachedMessages > 0 {
 					for _, b := range r.payloadCache {
-						req.peer.SendData(b)
+						if since == 0 || payloadSeq(b) > since {
+							req.peer.SendData(b)
+						}
 					}
 				}
 
-				if len(r.motd) > 0 {
+				r.sendReactions(req.peer)
+				r.sendReadMarks(req.peer)
+				r.sendMail(req.peer)
+
+				if len(r.motd) > 0 && since == 0 {
 					req.peer.SendData(r.makeMessagePayload(r.motd, req.peer, TypeMotd))
 				}
 
+				if resumed {
+					r.hub.log.Printf("%s@%s reconnected to %s", req.peer.Handle, req.peer.ID, r.ID)
+					continue
+				}
+
 				// Notify all peers of the new addition.
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
+				r.publish(clusterEvent{Type: clusterPeerJoin, Peer: req.peer.msgPeer()})
+				r.broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
 				r.hub.log.Printf("%s@%s joined %s", req.peer.Handle, req.peer.ID, r.ID)
 
-			// A peer has left.
+			// A peer has left. Unless it was kicked out, give it some
+			// time to reconnect before notifying the others. A connection
+			// replaced by a newer one of the same session leaves silently.
 			case TypePeerLeave:
+				_, ok := r.peers[req.peer]
 				r.removePeer(req.peer)
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
-				r.hub.log.Printf("%s@%s left %s", req.peer.Handle, req.peer.ID, r.ID)
+				if !ok || r.peerByID(req.peer.ID) != nil {
+					continue
+				}
+				if r.hub.Config().ReconnectGrace <= 0 || req.peer.kicked {
+					r.announceLeave(req.peer)
+					continue
+				}
+				r.leaving[req.peer.ID] = leavingPeer{peer: req.peer, at: time.Now()}
+				if r.leavingTick == nil {
+					r.leavingTick = time.After(r.hub.Config().ReconnectGrace)
+				}
 
 			// A peer has requested the room's peer list.
 			case TypePeerList:
 				req.peer.SendData(r.makePeerListPayload())
 			}
 
-		// Fanout broadcast to all peers.
-		case m, ok := <-r.broadcastQ:
-			if !ok {
-				break loop
-			}
-			for p := range r.peers {
-				p.SendData(m)
-			}
+		// Peers that didn't reconnect in time have left.
+		case <-r.leavingTick:
+			r.leavingTick = nil
+			r.expireLeaving()
 
-			// Extend the room's expiry (once every 30 seconds).
-			if !r.Predefined {
-				if time.Since(r.timestamp) > time.Duration(30)*time.Second {
-					r.timestamp = time.Now()
-					r.extendTTL()
-				}
-			}
+		// Messages at the end of their lifetime.
+		case <-r.expiryTick:
+			r.expiryTick = nil
+			r.expireMessages()
 
 		// Kill the room after the inactivity period.
-		case <-time.After(r.hub.cfg.RoomAge):
+		case <-time.After(r.hub.Config().RoomAge):
 			break loop
 		}
 	}
 
 	r.hub.log.Printf("stopped room: %v", r.ID)
 	r.remove()
+	close(r.done)
+}
+
+// lastActive returns the time of the room's last broadcast, or of its
+// creation.
+func (r *Room) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastActivity))
+}
+
+// evict stops the room if it has no peers, leaving it in the store, and waits
+// for it to be removed from the hub. It returns false if the room has peers
+// or is already stopped.
+func (r *Room) evict() bool {
+	if !r.do(func() { r.unloaded = len(r.peers) == 0 && len(r.leaving) == 0 }) || !r.unloaded {
+		return false
+	}
+	<-r.done
+	return true
+}
+
+// shutdown sends the room's peers a server restart notice with the delay
+// after which to reconnect, disconnects them once their queued payloads are
+// written, and stops the room. Their departure is only announced to the
+// other instances, which would otherwise keep them as remote peers.
+func (r *Room) shutdown(hint time.Duration) {
+	r.do(func() {
+		b := r.makePayload(payloadRestart{ReconnectIn: hint.Milliseconds()}, TypeServerRestart)
+
+		// The listeners of the disconnected peers must not queue leave
+		// requests any more.
+		r.closed = true
+		for p := range r.peers {
+			p.SendData(b)
+			r.removePeer(p)
+			r.publish(clusterEvent{Type: clusterPeerLeave, Peer: p.msgPeer()})
+		}
+		for _, l := range r.leaving {
+			r.publish(clusterEvent{Type: clusterPeerLeave, Peer: l.peer.msgPeer()})
+		}
+		r.leaving = make(map[string]leavingPeer)
+		r.unloaded = true
+	})
+}
+
+// do runs f in the room's goroutine and waits for it to return. It returns
+// false if the room has stopped.
+func (r *Room) do(f func()) bool {
+	ran := make(chan struct{})
+	select {
+	case r.op <- func() {
+		f()
+		close(ran)
+	}:
+	case <-r.done:
+		return false
+	}
+	<-ran
+	return true
+}
+
+// announceLeave notifies all peers that a peer has left.
+func (r *Room) announceLeave(p *Peer) {
+	delete(r.readMarks, p.ID)
+	r.publish(clusterEvent{Type: clusterPeerLeave, Peer: p.msgPeer()})
+	r.broadcast(r.makePeerUpdatePayload(p, TypePeerLeave), true)
+	r.hub.log.Printf("%s@%s left %s", p.Handle, p.ID, r.ID)
+}
+
+// expireLeaving announces the departure of the peers whose reconnect grace
+// period is over, and schedules the next check if some remain.
+func (r *Room) expireLeaving() {
+	var next time.Duration
+	for id, l := range r.leaving {
+		left := r.hub.Config().ReconnectGrace - time.Since(l.at)
+		if left <= 0 {
+			delete(r.leaving, id)
+			r.announceLeave(l.peer)
+			continue
+		}
+		if next == 0 || left < next {
+			next = left
+		}
+	}
+	if next > 0 {
+		r.leavingTick = time.After(next)
+	}
 }
 
 // extendTTL extends a room's TTL in the store.
 func (r *Room) extendTTL() {
-	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.cfg.RoomAge)
+	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.Config().RoomAge)
 }
 
 // remove disposes a room by notifying and disconnecting all peers and
@@ -384,29 +733,122 @@ func (r *Room) remove() {
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomDispose))
 		delete(r.peers, peer)
 	}
+	atomic.StoreInt32(&r.numPeers, 0)
 
 	// Close all room channels.
-	close(r.broadcastQ)
 	close(r.peerQ)
 	close(r.forwardQ)
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+
+	// In cluster mode, an idle room may still be active on other instances,
+	// leave it to the store's expiry. So is an unloaded room, which can be
+	// activated again.
+	if (r.hub.Bus != nil && !r.disposed) || r.unloaded {
+		r.hub.deactivateRoom(r.ID)
+		return
+	}
 	r.hub.removeRoom(r.ID)
 }
 
 // recordMsgPayload records message payloads (events) sent out. It maintains last
 // N messages to be sent to new users when they join.
 func (r *Room) recordMsgPayload(b []byte) {
-	if r.hub.cfg.MaxCachedMessages == 0 {
+	if r.hub.Config().MaxCachedMessages == 0 {
 		return
 	}
 
 	n := len(r.payloadCache)
-	if n >= r.hub.cfg.MaxCachedMessages {
+	if n >= r.hub.Config().MaxCachedMessages {
 		r.payloadCache = r.payloadCache[1:]
 	}
 
 	r.payloadCache = append(r.payloadCache, b)
 }
 
+// recordHistory writes a chat or upload payload to the room's persistent
+// history, if it has one.
+func (r *Room) recordHistory(b []byte) {
+	if !r.history.Enabled {
+		return
+	}
+	if err := r.hub.Store.AddHistory(r.ID, b, r.history.MaxMessages, r.history.TTL); err != nil {
+		r.hub.log.Printf("error recording history of room %s: %v", r.ID, err)
+	}
+}
+
+// sendHistory sends the room's persistent history after the given sequence
+// ID to the given peer.
+func (r *Room) sendHistory(p *Peer, since uint64) {
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return
+	}
+	for _, b := range hist {
+		if since == 0 || payloadSeq(b) > since {
+			p.SendData(b)
+		}
+	}
+}
+
+// loadSeq resumes the room's sequence IDs after the last payload of its
+// persistent history, so that they keep increasing across restarts.
+func (r *Room) loadSeq() {
+	if !r.history.Enabled {
+		return
+	}
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return
+	}
+	if len(hist) > 0 {
+		r.raiseSeq(payloadSeq(hist[len(hist)-1]))
+	}
+}
+
+// nextSeq returns the room's next sequence ID. In cluster mode, it's taken
+// from the counter the instances share in the store so that they don't
+// hand out the same IDs. The counter catches up with the room's ID if it's
+// behind, like after a restart of the store.
+func (r *Room) nextSeq() uint64 {
+	if r.hub.Bus == nil {
+		return atomic.AddUint64(&r.seq, 1)
+	}
+
+	seq, err := r.hub.Store.AddSeq(r.ID, 1)
+	if cur := atomic.LoadUint64(&r.seq); err == nil && seq <= cur {
+		seq, err = r.hub.Store.AddSeq(r.ID, cur-seq+1)
+	}
+	if err != nil {
+		r.hub.log.Printf("error allocating sequence ID in room %s: %v", r.ID, err)
+		return atomic.AddUint64(&r.seq, 1)
+	}
+	r.raiseSeq(seq)
+	return seq
+}
+
+// raiseSeq makes sure the next sequence IDs are greater than the given one.
+func (r *Room) raiseSeq(seq uint64) {
+	for {
+		cur := atomic.LoadUint64(&r.seq)
+		if seq <= cur || atomic.CompareAndSwapUint64(&r.seq, cur, seq) {
+			return
+		}
+	}
+}
+
+// payloadSeq returns the sequence ID of an encoded payload.
+func payloadSeq(b []byte) uint64 {
+	var m struct {
+		Seq uint64 `json:"seq"`
+	}
+	json.Unmarshal(b, &m)
+	return m.Seq
+}
+
 // queuePeerReq queues a peer addition / removal request to the room.
 func (r *Room) queuePeerReq(reqType string, p *Peer) {
 	if r.closed {
@@ -418,13 +860,14 @@ func (r *Room) queuePeerReq(reqType string, p *Peer) {
 // removePeer removes a peer from the room and broadcasts a message to the
 // room notifying all peers of the action.
 func (r *Room) removePeer(p *Peer) {
-	close(p.dataQ)
+	p.close()
 	delete(r.peers, p)
+	atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
 }
 
 // sendPeerList sends the peer list to the given peer.
-func (r *Room) forwardTo(typ, to string, data interface{}) {
-	r.forwardQ <- forwardReq{reqType: typ, to: to, data: data}
+func (r *Room) forwardTo(typ string, from *Peer, to string, data interface{}) {
+	r.forwardQ <- forwardReq{reqType: typ, from: from, to: to, data: data}
 }
 
 // sendPeerList sends the peer list to the given peer.
@@ -434,21 +877,29 @@ func (r *Room) sendPeerList(p *Peer) {
 
 // makePeerListPayload prepares a message payload with the list of peers.
 func (r *Room) makePeerListPayload() []byte {
-	peers := make([]payloadMsgPeer, 0, len(r.peers))
+	return r.makePayload(r.peerList(), TypePeerList)
+}
+
+// peerList returns the room's peers, local, leaving and on the other
+// instances.
+func (r *Room) peerList() []payloadMsgPeer {
+	peers := make([]payloadMsgPeer, 0, len(r.peers)+len(r.remotePeers)+len(r.leaving))
 	for p := range r.peers {
-		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle})
+		peers = append(peers, *p.msgPeer())
+	}
+	for _, l := range r.leaving {
+		peers = append(peers, *l.peer.msgPeer())
+	}
+	for _, p := range r.remotePeers {
+		peers = append(peers, p)
 	}
-	return r.makePayload(peers, TypePeerList)
+	return peers
 }
 
 // makePeerUpdatePayload prepares a message payload representing a peer
 // join / leave event.
 func (r *Room) makePeerUpdatePayload(p *Peer, peerUpdateType string) []byte {
-	d := payloadMsgPeer{
-		ID:     p.ID,
-		Handle: p.Handle,
-	}
-	return r.makePayload(d, peerUpdateType)
+	return r.makePayload(p.msgPeer(), peerUpdateType)
 }
 
 // makeMessagePayload prepares a chat message.
@@ -461,6 +912,21 @@ func (r *Room) makeMessagePayload(msg string, p *Peer, typ string) []byte {
 	return r.makePayload(d, typ)
 }
 
+// makeChatPayload prepares a chat message with the given ID, replying to
+// the quoted message if any, and expiring at the given time if any.
+func (r *Room) makeChatPayload(id, msg string, quote *payloadMsgQuote, expiresAt *time.Time, action bool, p *Peer) []byte {
+	d := payloadMsgChat{
+		ID:         id,
+		PeerID:     p.ID,
+		PeerHandle: p.Handle,
+		Msg:        msg,
+		Action:     action,
+		ReplyTo:    quote,
+		ExpiresAt:  expiresAt,
+	}
+	return r.makePayload(d, TypeMessage)
+}
+
 // makeUploadPayload prepares an upload message.
 func (r *Room) makeUploadPayload(data interface{}, p *Peer, typ string) []byte {
 	d := payloadUpload{
@@ -471,9 +937,10 @@ func (r *Room) makeUploadPayload(data interface{}, p *Peer, typ string) []byte {
 	return r.makePayload(d, typ)
 }
 
-// makePayload prepares a message payload.
+// makePayload prepares a message payload, with the room's next sequence ID.
 func (r *Room) makePayload(data interface{}, typ string) []byte {
 	m := payloadMsgWrap{
+		Seq:       r.nextSeq(),
 		Timestamp: time.Now(),
 		Type:      typ,
 		Data:      data,
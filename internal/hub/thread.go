@@ -0,0 +1,152 @@
+package hub
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// Maximum number of characters of the quoted excerpt of a message replied to.
+const quoteLen = 100
+
+// payloadMsgQuote references the message a chat message replies to.
+type payloadMsgQuote struct {
+	ID string `json:"id"`
+	// ID of the first message of the thread.
+	Thread     string `json:"thread"`
+	PeerHandle string `json:"peer_handle"`
+	Excerpt    string `json:"excerpt"`
+}
+
+// payloadThread is the response to a thread request, with the thread's
+// messages in the order they were sent.
+type payloadThread struct {
+	ID       string            `json:"id"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// quote returns the reference to the chat message with the given ID for a
+// reply, or nil if the message is not in the room's recorded payloads or
+// was deleted. It must be called from the room's goroutine.
+func (r *Room) quote(id string) *payloadMsgQuote {
+	_, m, ok := r.findMessage(id)
+	if !ok {
+		return nil
+	}
+	c := m.Data.(*payloadMsgChat)
+	if c.Deleted {
+		return nil
+	}
+	q := &payloadMsgQuote{
+		ID:         c.ID,
+		Thread:     c.ID,
+		PeerHandle: c.PeerHandle,
+	}
+	// A ciphertext can't be cut, and a message with a lifetime must not
+	// outlive it in its replies. The peers quote it themselves.
+	if !r.Encrypted && c.ExpiresAt == nil {
+		q.Excerpt = excerpt(c.Msg, quoteLen)
+	}
+	if c.ReplyTo != nil {
+		q.Thread = c.ReplyTo.Thread
+	}
+	return q
+}
+
+// scrubQuotes removes the excerpts of a deleted chat message from the
+// replies to it in the room's cache, and in its pins and the persistent
+// history shared by the instances if local. It must be called from the
+// room's goroutine.
+func (r *Room) scrubQuotes(id string, local bool) {
+	for i, b := range r.payloadCache {
+		if s, ok := scrubQuote(b, id); ok {
+			r.payloadCache[i] = s
+		}
+	}
+	if !local {
+		return
+	}
+
+	var pinned bool
+	for i, b := range r.pins {
+		if s, ok := scrubQuote(b, id); ok {
+			r.pins[i] = s
+			pinned = true
+		}
+	}
+	if pinned {
+		r.pinsChanged("")
+	}
+
+	if !r.history.Enabled {
+		return
+	}
+	hist, err := r.hub.Store.GetHistory(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error reading history of room %s: %v", r.ID, err)
+		return
+	}
+	for _, b := range hist {
+		s, ok := scrubQuote(b, id)
+		if !ok {
+			continue
+		}
+		if err := r.hub.Store.ReplaceHistory(r.ID, b, s); err != nil {
+			r.hub.log.Printf("error updating history of room %s: %v", r.ID, err)
+		}
+	}
+}
+
+// scrubQuote returns an encoded chat message replying to the message with
+// the given ID without the excerpt of the latter, if it has one.
+func scrubQuote(b []byte, id string) ([]byte, bool) {
+	m, ok := decodeMessage(b)
+	if !ok {
+		return nil, false
+	}
+	c := m.Data.(*payloadMsgChat)
+	if c.ReplyTo == nil || c.ReplyTo.ID != id || c.ReplyTo.Excerpt == "" {
+		return nil, false
+	}
+	c.ReplyTo.Excerpt = ""
+	s, err := json.Marshal(m)
+	if err != nil {
+		return nil, false
+	}
+	return s, true
+}
+
+// sendThread sends the peer the recorded messages of the thread of the
+// message with the given ID. It must be called from the room's goroutine.
+func (r *Room) sendThread(p *Peer, id string) {
+	_, m, ok := r.findMessage(id)
+	if !ok {
+		p.SendData(r.makePayload("message not found", TypeNotice))
+		return
+	}
+	thread := id
+	if c := m.Data.(*payloadMsgChat); c.ReplyTo != nil {
+		thread = c.ReplyTo.Thread
+	}
+
+	out := payloadThread{ID: thread, Messages: []json.RawMessage{}}
+	for _, b := range r.recordedPayloads() {
+		m, ok := decodeMessage(b)
+		if !ok {
+			continue
+		}
+		c := m.Data.(*payloadMsgChat)
+		if c.ID == thread || (c.ReplyTo != nil && c.ReplyTo.Thread == thread) {
+			out.Messages = append(out.Messages, b)
+		}
+	}
+	p.SendData(r.makePayload(out, TypeThread))
+}
+
+// excerpt returns the first n characters of s, with an ellipsis if it's
+// longer.
+func excerpt(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
@@ -1,55 +1,54 @@
 package hub
 
 import (
-	"sync"
+	"errors"
 	"time"
 )
 
-// loginToken handles login via temporary tokens passed in url.
-type loginToken struct {
-	handle  string
-	token   string
-	expires time.Time
-}
-
-type tokenStore struct {
-	m      sync.Mutex
-	tokens map[string]loginToken
-}
+// Lifetime of the autologin tokens sent with the growl notifications.
+const tokenTTL = 10 * time.Minute
 
-func newTokenStore() *tokenStore {
-	return &tokenStore{
-		tokens: make(map[string]loginToken),
+// newLoginToken creates a single-use autologin token of a user of the room,
+// kept in the store to work across restarts and instances.
+func (r *Room) newLoginToken(handle string) (string, error) {
+	tok, err := GenerateGUID(32)
+	if err != nil {
+		r.hub.log.Printf("error generating token: %v", err)
+		return "", errors.New("error generating token")
 	}
+	if err := r.hub.Store.AddToken(r.ID, tok, handle, tokenTTL); err != nil {
+		r.hub.log.Printf("error storing token: %v", err)
+		return "", errors.New("error storing token")
+	}
+	return tok, nil
 }
 
-func (t *tokenStore) getOrCreateToken(handle string) string {
-	t.m.Lock()
-	defer t.m.Unlock()
-	tok, ok := t.tokens[handle]
-	if ok && !tok.expires.Before(time.Now()) {
-		tok.expires = tok.expires.Add(time.Minute * 10)
-		t.tokens[handle] = tok
-		return tok.token
+// checkToken returns the user of an autologin token of the room and revokes
+// the token. The user is empty if the token is invalid. It must not be
+// called from the room's goroutine.
+func (r *Room) checkToken(tok string) (string, error) {
+	handle, err := r.hub.Store.TakeToken(r.ID, tok)
+	if err != nil {
+		r.hub.log.Printf("error reading token: %v", err)
+		return "", errors.New("error reading token")
 	}
-	uid, _ := GenerateGUID(32)
-	tok = loginToken{
-		expires: time.Now().Add(time.Minute * 10),
-		handle:  handle,
-		token:   uid,
+
+	// The user may have been removed from the configuration since.
+	var ok bool
+	r.do(func() {
+		ok = handle != "" && r.isPredefinedUser(handle)
+	})
+	if !ok {
+		return "", nil
 	}
-	t.tokens[handle] = tok
-	return tok.token
+	return handle, nil
 }
 
-func (t *tokenStore) checkToken(tokvalue string) string {
-	t.m.Lock()
-	defer t.m.Unlock()
-	for _, tok := range t.tokens {
-		if tok.token == tokvalue && !tok.expires.Before(time.Now()) {
-			delete(t.tokens, tok.handle)
-			return tok.handle
-		}
+// RevokeTokens revokes the autologin tokens of a user of the room.
+func (r *Room) RevokeTokens(handle string) error {
+	if err := r.hub.Store.RevokeTokens(r.ID, handle); err != nil {
+		r.hub.log.Printf("error revoking tokens: %v", err)
+		return err
 	}
-	return ""
+	return nil
 }
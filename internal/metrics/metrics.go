@@ -0,0 +1,268 @@
+// Package metrics implements the few metric types the app exposes to
+// operators, written in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the app's metrics are registered on.
+var Default = &Registry{}
+
+// Registry is a set of metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// family is a named metric with its samples.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	collect func(emit emitFunc)
+}
+
+// emitFunc writes a sample of a metric, the name suffix being used by
+// histograms.
+type emitFunc func(suffix string, labels []label, v float64)
+
+type label struct {
+	name, value string
+}
+
+func (r *Registry) register(name, help, typ string, collect func(emit emitFunc)) {
+	r.mu.Lock()
+	r.families = append(r.families, family{name: name, help: help, typ: typ, collect: collect})
+	r.mu.Unlock()
+}
+
+// labelEscaper escapes label values the way the text format requires. Unlike
+// strconv.Quote, it leaves the other characters as they are.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteTo writes all the metrics of the registry in the Prometheus text
+// format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]family, len(r.families))
+	copy(families, r.families)
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		f.collect(func(suffix string, labels []label, v float64) {
+			cw.WriteString(f.name + suffix)
+			if len(labels) > 0 {
+				cw.WriteString("{")
+				for i, l := range labels {
+					if i > 0 {
+						cw.WriteString(",")
+					}
+					cw.WriteString(l.name + `="` + labelEscaper.Replace(l.value) + `"`)
+				}
+				cw.WriteString("}")
+			}
+			cw.WriteString(" " + formatFloat(v) + "\n")
+		})
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the registry's metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Counter is a value that only goes up, split by label values.
+type Counter struct {
+	labels []string
+	mu     sync.Mutex
+	values map[string]*uint64
+}
+
+// NewCounter registers a new counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{labels: labels, values: make(map[string]*uint64)}
+	r.register(name, help, "counter", func(emit emitFunc) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, k := range sortedKeys(c.values) {
+			emit("", makeLabels(c.labels, k), float64(atomic.LoadUint64(c.values[k])))
+		}
+	})
+	return c
+}
+
+// Inc increments the counter for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n to the counter for the given label values.
+func (c *Counter) Add(n uint64, labelValues ...string) {
+	k := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	v, ok := c.values[k]
+	if !ok {
+		v = new(uint64)
+		c.values[k] = v
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(v, n)
+}
+
+// Histogram counts observations in buckets, split by label values.
+type Histogram struct {
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histValue
+}
+
+type histValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a new histogram with the given bucket upper bounds
+// and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{labels: labels, buckets: buckets, values: make(map[string]*histValue)}
+	r.register(name, help, "histogram", func(emit emitFunc) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, k := range sortedKeys(h.values) {
+			var (
+				v  = h.values[k]
+				ls = makeLabels(h.labels, k)
+			)
+			for i, b := range h.buckets {
+				emit("_bucket", append(ls, label{"le", formatFloat(b)}), float64(v.counts[i]))
+			}
+			emit("_bucket", append(ls, label{"le", "+Inf"}), float64(v.count))
+			emit("_sum", ls, v.sum)
+			emit("_count", ls, float64(v.count))
+		}
+	})
+	return h
+}
+
+// Observe records a value for the given label values.
+func (h *Histogram) Observe(f float64, labelValues ...string) {
+	k := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[k]
+	if !ok {
+		v = &histValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = v
+	}
+	for i, b := range h.buckets {
+		if f <= b {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += f
+}
+
+// Sample is a value of a gauge with its label values.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// NewGauge registers a gauge whose samples are read from the given function
+// on collection.
+func (r *Registry) NewGauge(name, help string, read func() []Sample, labels ...string) {
+	r.registerFunc(name, help, "gauge", read, labels)
+}
+
+// NewCounterFunc registers a counter whose samples are read from the given
+// function on collection, for values counted elsewhere.
+func (r *Registry) NewCounterFunc(name, help string, read func() []Sample, labels ...string) {
+	r.registerFunc(name, help, "counter", read, labels)
+}
+
+func (r *Registry) registerFunc(name, help, typ string, read func() []Sample, labels []string) {
+	r.register(name, help, typ, func(emit emitFunc) {
+		for _, s := range read() {
+			ls := make([]label, len(labels))
+			for i, n := range labels {
+				ls[i] = label{n, s.LabelValues[i]}
+			}
+			emit("", ls, s.Value)
+		}
+	})
+}
+
+// makeLabels pairs label names with the values joined in a map key.
+func makeLabels(names []string, key string) []label {
+	if len(names) == 0 {
+		return nil
+	}
+	values := strings.Split(key, "\xff")
+	ls := make([]label, len(names), len(names)+1)
+	for i, n := range names {
+		ls[i] = label{n, values[i]}
+	}
+	return ls
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written.
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countWriter) WriteString(s string) {
+	n, _ := c.w.WriteString(s)
+	c.n += int64(n)
+}
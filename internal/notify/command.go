@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// command runs a command for each notification. The notification is given
+// in its environment, and its body on stdin.
+type command struct {
+	args []string
+}
+
+func newCommand(args []string) *command {
+	return &command{args: args}
+}
+
+func (c *command) Notify(n Notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NILTALK_ROOM="+n.Room,
+		"NILTALK_TO="+n.To,
+		"NILTALK_FROM="+n.From,
+		"NILTALK_TITLE="+n.Title,
+		"NILTALK_MESSAGE="+n.Body,
+		"NILTALK_URL="+n.URL,
+	)
+	cmd.Stdin = strings.NewReader(n.Body)
+	return cmd.Run()
+}
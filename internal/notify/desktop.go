@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rice "github.com/GeertJohan/go.rice"
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/flac"
+	"github.com/faiface/beep/mp3"
+	"github.com/faiface/beep/speaker"
+	"github.com/faiface/beep/wav"
+	"github.com/gen2brain/beeep"
+)
+
+// desktop shows the notifications on the server's own desktop and plays a
+// sound, if any.
+type desktop struct {
+	soundBuffer *beep.Buffer
+}
+
+// newDesktop returns a desktop notifier playing the given sound, an URL or a
+// path in the assets.
+func newDesktop(sound string, box *rice.Box) (*desktop, error) {
+	d := &desktop{}
+	if sound == "" {
+		return d, nil
+	}
+
+	var r io.ReadCloser
+	var err error
+	if strings.HasPrefix(sound, "http://") ||
+		strings.HasPrefix(sound, "https://") {
+		var resp *http.Response
+		resp, err = http.Get(sound)
+		if err == nil {
+			z := new(bytes.Buffer)
+			_, err = io.Copy(z, resp.Body)
+			resp.Body.Close()
+			r = ioutil.NopCloser(z)
+		}
+	} else {
+		r, err = box.Open(sound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var (
+		streamer beep.StreamSeekCloser
+		format   beep.Format
+	)
+	switch filepath.Ext(sound) {
+	case ".mp3":
+		streamer, format, err = mp3.Decode(r)
+	case ".wav":
+		streamer, format, err = wav.Decode(r)
+	case ".flac":
+		streamer, format, err = flac.Decode(r)
+	default:
+		err = errors.New("unsupported sound format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10)); err != nil {
+		return nil, err
+	}
+	buffer := beep.NewBuffer(format)
+	buffer.Append(streamer)
+	streamer.Close()
+	d.soundBuffer = buffer
+	return d, nil
+}
+
+func (d *desktop) Notify(n Notification) error {
+	if err := beeep.Notify(n.Title, n.Body, ""); err != nil {
+		return err
+	}
+	if d.soundBuffer != nil {
+		speaker.Play(d.soundBuffer.Streamer(0, d.soundBuffer.Len()))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// email sends the notifications to the user's email address.
+type email struct {
+	smtp SMTPOptions
+	to   string
+}
+
+func newEmail(o SMTPOptions, to string) *email {
+	if o.Port == 0 {
+		o.Port = 25
+	}
+	return &email{smtp: o, to: to}
+}
+
+func (e *email) Notify(n Notification) error {
+	var auth smtp.Auth
+	if e.smtp.Username != "" {
+		auth = smtp.PlainAuth("", e.smtp.Username, e.smtp.Password, e.smtp.Host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.smtp.From)
+	fmt.Fprintf(&b, "To: %s\r\n", e.to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Title))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(n.Body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+
+	return e.send(auth, []byte(b.String()))
+}
+
+// send delivers a message the way smtp.SendMail does, within sendTimeout,
+// which smtp.SendMail has no way of setting.
+func (e *email) send(auth smtp.Auth, msg []byte) error {
+	addr := net.JoinHostPort(e.smtp.Host, strconv.Itoa(e.smtp.Port))
+	conn, err := net.DialTimeout("tcp", addr, sendTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	c, err := smtp.NewClient(conn, e.smtp.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.smtp.Host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(e.smtp.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(e.to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpStub is an SMTP server accepting a single message.
+type smtpStub struct {
+	l    net.Listener
+	from string
+	rcpt []string
+	data string
+	done chan struct{}
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &smtpStub{l: l, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *smtpStub) serve() {
+	defer close(s.done)
+	conn, err := s.l.Accept()
+	if err != nil {
+		return
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			c.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			c.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.rcpt = append(s.rcpt, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			c.PrintfLine("250 OK")
+		case cmd == "DATA":
+			c.PrintfLine("354 Go ahead")
+			b, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.data = string(b)
+			c.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	s := newSMTPStub(t)
+	defer s.l.Close()
+
+	addr := s.l.Addr().(*net.TCPAddr)
+	o := SMTPOptions{Host: addr.IP.String(), Port: addr.Port, From: "niltalk@localhost"}
+
+	n := Notification{Title: "Growl", Body: "line 1\nline 2"}
+	if err := newEmail(o, "user@localhost").Notify(n); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+	<-s.done
+
+	if s.from != "niltalk@localhost" {
+		t.Errorf("sender = %q, want %q", s.from, "niltalk@localhost")
+	}
+	if len(s.rcpt) != 1 || s.rcpt[0] != "user@localhost" {
+		t.Errorf("recipients = %q, want [user@localhost]", s.rcpt)
+	}
+	for _, want := range []string{"To: user@localhost\n", "Subject: Growl\n",
+		"Content-Type: text/plain; charset=utf-8\n", "\nline 1\nline 2\n"} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message %q doesn't contain %q", s.data, want)
+		}
+	}
+}
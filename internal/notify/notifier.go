@@ -2,54 +2,110 @@ package notify
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"html/template"
-	"io"
-	"io/ioutil"
+	htmltemplate "html/template"
 	"log"
-	"net/http"
-	"path/filepath"
 	"strconv"
-	"strings"
-
+	"text/template"
 	"time"
 
 	rice "github.com/GeertJohan/go.rice"
-	"github.com/faiface/beep"
-	"github.com/faiface/beep/flac"
-	"github.com/faiface/beep/mp3"
-	"github.com/faiface/beep/speaker"
-	"github.com/faiface/beep/wav"
-	"github.com/gen2brain/beeep"
 	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/metrics"
 	"golang.org/x/time/rate"
 )
 
-type Notifier struct {
-	BaseURL     string
-	RoomID      string
-	Logger      *log.Logger
-	Options     Options
-	tpl         *template.Template
-	limiter     *rate.Limiter
-	soundBuffer *beep.Buffer
-	box         *rice.Box
+var metricGrowls = metrics.Default.NewCounter("niltalk_growl_notifications_total",
+	"Notifications sent for predefined users.", "room")
+
+// Notification is a rendered notification for an offline predefined user.
+type Notification struct {
+	Room  string `json:"room"`
+	To    string `json:"to"`
+	From  string `json:"from"`
+	Title string `json:"title"`
+	Body  string `json:"message"`
+	// Autologin URL of the room.
+	URL string `json:"url"`
+}
+
+// Notifier delivers notifications to a predefined user.
+type Notifier interface {
+	Notify(n Notification) error
 }
 
+// Kinds of notifiers a predefined user can choose.
+const (
+	KindDesktop = "desktop"
+	KindWebhook = "webhook"
+	KindEmail   = "email"
+	KindNtfy    = "ntfy"
+	KindGotify  = "gotify"
+	KindCommand = "command"
+)
+
+// Timeout of the notifiers' requests and commands.
+const sendTimeout = 10 * time.Second
+
+// Options are the notification options of a room.
 type Options struct {
-	Icon            string `koanf:"icon"`
-	Enabler         string `koanf:"enabler"`
-	Message         string `koanf:"message"`
-	Title           string `koanf:"title"`
-	Sound           string `koanf:"sound"`
-	RateLimitPeriod string `koanf:"rate-limit-period"`
-	RateLimitCount  string `koanf:"rate-limit-count"`
-	RateLimitBurst  string `koanf:"rate-limit-burst"`
+	Icon            string      `koanf:"icon"`
+	Enabler         string      `koanf:"enabler"`
+	Message         string      `koanf:"message"`
+	Title           string      `koanf:"title"`
+	Sound           string      `koanf:"sound"`
+	RateLimitPeriod string      `koanf:"rate-limit-period"`
+	RateLimitCount  string      `koanf:"rate-limit-count"`
+	RateLimitBurst  string      `koanf:"rate-limit-burst"`
+	SMTP            SMTPOptions `koanf:"smtp"`
+}
+
+// SMTPOptions are the options of the server sending the email notifications.
+type SMTPOptions struct {
+	Host     string `koanf:"host"`
+	Port     int    `koanf:"port"`
+	Username string `koanf:"username"`
+	Password string `koanf:"password"`
+	From     string `koanf:"from"`
 }
 
-func New(opt Options, baseURL, roomID string, logger *log.Logger, box *rice.Box) *Notifier {
-	return &Notifier{
+// UserOptions choose how a predefined user is notified. The desktop
+// notifier is the default.
+type UserOptions struct {
+	Kind string `koanf:"kind"`
+	// URL of the webhook, of the ntfy topic or of the Gotify server.
+	URL string `koanf:"url"`
+	// Access token of the ntfy topic or application token of Gotify. It's
+	// sent as a bearer token to the webhook.
+	Token string `koanf:"token"`
+	// Email address of the user.
+	Email string `koanf:"email"`
+	// Command run with its arguments, the notification is passed in its
+	// environment and its body on stdin.
+	Command []string `koanf:"command"`
+}
+
+// Dispatcher renders the notifications of a room and sends them through the
+// notifiers of its users.
+type Dispatcher struct {
+	BaseURL   string
+	RoomID    string
+	Logger    *log.Logger
+	Options   Options
+	Users     map[string]UserOptions
+	tpl       *template.Template
+	htmlTpl   *htmltemplate.Template
+	limiter   *rate.Limiter
+	notifiers map[string]Notifier
+	box       *rice.Box
+}
+
+// New returns a dispatcher of the notifications to the given users of a room.
+func New(opt Options, users map[string]UserOptions, baseURL, roomID string, logger *log.Logger, box *rice.Box) *Dispatcher {
+	return &Dispatcher{
 		Options: opt,
+		Users:   users,
 		BaseURL: baseURL,
 		RoomID:  roomID,
 		Logger:  logger,
@@ -57,7 +113,7 @@ func New(opt Options, baseURL, roomID string, logger *log.Logger, box *rice.Box)
 	}
 }
 
-func (n *Notifier) Init() error {
+func (n *Dispatcher) Init() error {
 	{
 		t, err := template.New("").Parse(n.Options.Message)
 		if err != nil {
@@ -65,53 +121,40 @@ func (n *Notifier) Init() error {
 			return err
 		}
 		n.tpl = t
-	}
 
-	if n.Options.Sound != "" {
-		var r io.ReadCloser
-		var err error
-		if strings.HasPrefix(n.Options.Sound, "http://") ||
-			strings.HasPrefix(n.Options.Sound, "https://") {
-			var resp *http.Response
-			resp, err = http.Get(n.Options.Sound)
-			if err == nil {
-				z := new(bytes.Buffer)
-				_, err = io.Copy(z, resp.Body)
-				resp.Body.Close()
-				r = ioutil.NopCloser(z)
-			}
-		} else {
-			r, err = n.box.Open(n.Options.Sound)
-		}
+		// Some notification daemons render the desktop notifications as
+		// markup, the message is escaped for them.
+		h, err := htmltemplate.New("").Parse(n.Options.Message)
 		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
+			n.Logger.Printf("error compiling growl template for room %q: %v", n.RoomID, err)
 			return err
 		}
-		var (
-			streamer beep.StreamSeekCloser
-			format   beep.Format
-		)
-		switch filepath.Ext(n.Options.Sound) {
-		case ".mp3":
-			streamer, format, err = mp3.Decode(r)
-		case ".wav":
-			streamer, format, err = wav.Decode(r)
-		case ".flac":
-			streamer, format, err = flac.Decode(r)
-		}
-		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
-			return err
+		n.htmlTpl = h
+	}
+
+	// The users share the desktop notifier, and the sound it loads.
+	n.notifiers = make(map[string]Notifier, len(n.Users))
+	var desktop Notifier
+	for name, u := range n.Users {
+		if u.Kind == "" || u.Kind == KindDesktop {
+			if desktop == nil {
+				d, err := newDesktop(n.Options.Sound, n.box)
+				if err != nil {
+					n.Logger.Printf("error setting up desktop notifications for room %q: %v", n.RoomID, err)
+					return err
+				}
+				desktop = d
+			}
+			n.notifiers[name] = desktop
+			continue
 		}
-		err = speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
+
+		nt, err := newNotifier(u, n.Options.SMTP)
 		if err != nil {
-			n.Logger.Printf("error initializing sound system for room %q: %v", n.RoomID, err)
+			n.Logger.Printf("error setting up notifications of %q for room %q: %v", name, n.RoomID, err)
 			return err
 		}
-		buffer := beep.NewBuffer(format)
-		buffer.Append(streamer)
-		streamer.Close()
-		n.soundBuffer = buffer
+		n.notifiers[name] = nt
 	}
 
 	{
@@ -151,29 +194,82 @@ func (n *Notifier) Init() error {
 	return nil
 }
 
-// OnGrowlMessage handles growl notifications.
-func (n *Notifier) OnGrowlMessage(msg, handle, token string) {
+// newNotifier returns the notifier of a user, other than the desktop one.
+func newNotifier(u UserOptions, smtp SMTPOptions) (Notifier, error) {
+	switch u.Kind {
+	case KindWebhook:
+		if u.URL == "" {
+			return nil, errors.New("webhook notifier without url")
+		}
+		return newWebhook(u.URL, u.Token), nil
+
+	case KindEmail:
+		if u.Email == "" || smtp.Host == "" || smtp.From == "" {
+			return nil, errors.New("email notifier without email address, smtp host or sender")
+		}
+		return newEmail(smtp, u.Email), nil
+
+	case KindNtfy, KindGotify:
+		if u.URL == "" {
+			return nil, errors.New("push notifier without url")
+		}
+		return newPush(u.Kind, u.URL, u.Token), nil
+
+	case KindCommand:
+		if len(u.Command) == 0 {
+			return nil, errors.New("command notifier without command")
+		}
+		return newCommand(u.Command), nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", u.Kind)
+}
+
+// OnGrowlMessage notifies a user that a peer is calling them. token creates
+// the autologin token of the notification's link, it's only called if the
+// notification is sent.
+func (n *Dispatcher) OnGrowlMessage(to, from, msg string, token func() string) {
+	nt, ok := n.notifiers[to]
+	if !ok {
+		return
+	}
 	if n.limiter != nil && !n.limiter.Allow() {
 		return
 	}
-	body := n.Options.Message
-	var s bytes.Buffer
+
 	u := fmt.Sprintf("%v/r/%v", n.BaseURL, n.RoomID)
-	if len(token) > 0 {
+	if token := token(); len(token) > 0 {
 		u = fmt.Sprintf("%v/r/%v?al=%v", n.BaseURL, n.RoomID, token)
 	}
-	err := n.tpl.Execute(&s, map[string]interface{}{
+	exec := n.tpl.Execute
+	if _, ok := nt.(*desktop); ok {
+		exec = n.htmlTpl.Execute
+	}
+	body := n.Options.Message
+	var s bytes.Buffer
+	err := exec(&s, map[string]interface{}{
 		"URL":      u,
-		"UserName": handle,
+		"UserName": from,
+		"To":       to,
+		"Message":  msg,
+		"Room":     n.RoomID,
 	})
 	if err != nil {
 		n.Logger.Printf("error executing growl template for room %q: %v", n.RoomID, err)
 	} else {
 		body = s.String()
 	}
-	err = beeep.Notify(n.Options.Title, body, "")
+
+	err = nt.Notify(Notification{
+		Room:  n.RoomID,
+		To:    to,
+		From:  from,
+		Title: n.Options.Title,
+		Body:  body,
+		URL:   u,
+	})
 	if err != nil {
 		n.Logger.Printf("error sending notification for room %q: %v", n.RoomID, err)
+		return
 	}
-	speaker.Play(n.soundBuffer.Streamer(0, n.soundBuffer.Len()))
+	metricGrowls.Inc(n.RoomID)
 }
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// push sends the notifications to a ntfy topic or to a Gotify server, which
+// push them to the user's devices.
+type push struct {
+	kind  string
+	url   string
+	token string
+	c     *http.Client
+}
+
+func newPush(kind, url, token string) *push {
+	return &push{kind: kind, url: strings.TrimSuffix(url, "/"), token: token,
+		c: &http.Client{Timeout: sendTimeout}}
+}
+
+func (p *push) Notify(n Notification) error {
+	var (
+		req *http.Request
+		err error
+	)
+	if p.kind == KindGotify {
+		b, _ := json.Marshal(map[string]interface{}{
+			"title":   n.Title,
+			"message": n.Body,
+			"extras": map[string]interface{}{
+				"client::notification": map[string]interface{}{
+					"click": map[string]string{"url": n.URL},
+				},
+			},
+		})
+		if req, err = http.NewRequest(http.MethodPost, p.url+"/message", bytes.NewReader(b)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("X-Gotify-Key", p.token)
+	} else {
+		// ntfy takes the message as the body, the rest as headers.
+		if req, err = http.NewRequest(http.MethodPost, p.url, strings.NewReader(n.Body)); err != nil {
+			return err
+		}
+		req.Header.Set("Title", n.Title)
+		req.Header.Set("Click", n.URL)
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+	}
+	return send(p.c, req)
+}
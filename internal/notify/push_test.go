@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPushNtfy(t *testing.T) {
+	var (
+		body   string
+		header http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, header = string(b), r.Header
+	}))
+	defer srv.Close()
+
+	n := Notification{Title: "title", Body: "body", URL: "url"}
+	if err := newPush(KindNtfy, srv.URL, "token").Notify(n); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+	if body != "body" {
+		t.Errorf("body = %q, want %q", body, "body")
+	}
+	for h, want := range map[string]string{"Title": "title", "Click": "url", "Authorization": "Bearer token"} {
+		if got := header.Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+}
+
+func TestPushGotify(t *testing.T) {
+	var (
+		path, key string
+		msg       struct {
+			Title   string `json:"title"`
+			Message string `json:"message"`
+			Extras  struct {
+				Notification struct {
+					Click struct {
+						URL string `json:"url"`
+					} `json:"click"`
+				} `json:"client::notification"`
+			} `json:"extras"`
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, key = r.URL.Path, r.Header.Get("X-Gotify-Key")
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("error decoding message: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	n := Notification{Title: "title", Body: "body", URL: "url"}
+	if err := newPush(KindGotify, srv.URL+"/", "token").Notify(n); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+	if path != "/message" {
+		t.Errorf("path = %q, want %q", path, "/message")
+	}
+	if key != "token" {
+		t.Errorf("key = %q, want %q", key, "token")
+	}
+	if msg.Title != "title" || msg.Message != "body" || msg.Extras.Notification.Click.URL != "url" {
+		t.Errorf("message = %+v", msg)
+	}
+}
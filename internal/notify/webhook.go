@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// webhook posts the notifications as JSON to an URL.
+type webhook struct {
+	url   string
+	token string
+	c     *http.Client
+}
+
+func newWebhook(url, token string) *webhook {
+	return &webhook{url: url, token: token, c: &http.Client{Timeout: sendTimeout}}
+}
+
+func (w *webhook) Notify(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	return send(w.c, req)
+}
+
+// send sends a request and checks its response status.
+func send(c *http.Client, req *http.Request) error {
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
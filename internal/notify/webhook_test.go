@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		got  Notification
+		auth string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("error decoding notification: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	n := Notification{Room: "room", To: "to", From: "from", Title: "title", Body: "body", URL: "url"}
+	if err := newWebhook(srv.URL, "token").Notify(n); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+	if got != n {
+		t.Errorf("notification = %+v, want %+v", got, n)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("authorization = %q, want %q", auth, "Bearer token")
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	if err := newWebhook(srv.URL, "").Notify(Notification{}); err == nil {
+		t.Fatal("notifying succeeded with a 403 response")
+	}
+}
+
+// The growl message is rendered as plain text for the notifiers other than
+// the desktop one.
+func TestDispatcherPlainText(t *testing.T) {
+	var got Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	d := New(Options{Title: "growl", Message: "{{.UserName}}: {{.Message}}"},
+		map[string]UserOptions{"to": {Kind: KindWebhook, URL: srv.URL}},
+		"http://localhost", "room", log.New(ioutil.Discard, "", 0), nil)
+	if err := d.Init(); err != nil {
+		t.Fatalf("error initializing dispatcher: %v", err)
+	}
+
+	var tokens int
+	d.OnGrowlMessage("to", "from", `<b>"fish" & chips</b>`, func() string {
+		tokens++
+		return "tok"
+	})
+	if want := `from: <b>"fish" & chips</b>`; got.Body != want {
+		t.Errorf("body = %q, want %q", got.Body, want)
+	}
+	if want := "http://localhost/r/room?al=tok"; got.URL != want {
+		t.Errorf("url = %q, want %q", got.URL, want)
+	}
+	if tokens != 1 {
+		t.Errorf("%d tokens created, want 1", tokens)
+	}
+
+	// Users without a notifier don't get tokens.
+	d.OnGrowlMessage("other", "from", "hello", func() string {
+		tokens++
+		return "tok"
+	})
+	if tokens != 1 {
+		t.Errorf("%d tokens created, want 1", tokens)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/alecthomas/units"
 	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/metrics"
 )
 
 // Config represents the file upload options.
@@ -29,6 +30,9 @@ type Store struct {
 	items map[string]File
 	size  int64
 
+	// Number of files evicted to stay under MaxMemory.
+	evictions uint64
+
 	MaxMemory     int64
 	MaxUploadSize int64
 	MaxAge        time.Duration
@@ -95,6 +99,25 @@ func (s *Store) Init() error {
 	return nil
 }
 
+// Reconfigure parses new configuration values and applies them if they are
+// all valid.
+func (s *Store) Reconfigure(cfg Config) error {
+	n := &Store{cfg: cfg}
+	if err := n.Init(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cfg = cfg
+	s.MaxMemory = n.MaxMemory
+	s.MaxUploadSize = n.MaxUploadSize
+	s.MaxAge = n.MaxAge
+	s.RlPeriod = n.RlPeriod
+	s.RlCount = n.RlCount
+	s.RlBurst = n.RlBurst
+	s.mu.Unlock()
+	return nil
+}
+
 // File represents an upload.
 type File struct {
 	CreatedAt time.Time
@@ -145,6 +168,7 @@ func (s *Store) Add(name, mimeType string, data []byte) (File, error) {
 		}
 		if oldest != nil {
 			s.size -= int64(len(oldest.Data))
+			s.evictions++
 			delete(s.items, oldest.ID)
 		}
 	}
@@ -165,6 +189,28 @@ func (s *Store) Get(id string) (File, error) {
 	return up, nil
 }
 
+// Stats returns the number of bytes held by the store and the number of files
+// evicted so far.
+func (s *Store) Stats() (size int64, evictions uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, s.evictions
+}
+
+// RegisterMetrics registers the store's gauges on the given registry.
+func (s *Store) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGauge("niltalk_upload_store_bytes", "Bytes of uploaded files held in memory.",
+		func() []metrics.Sample {
+			size, _ := s.Stats()
+			return []metrics.Sample{{Value: float64(size)}}
+		})
+	reg.NewCounterFunc("niltalk_upload_evictions_total", "Uploaded files evicted to free memory.",
+		func() []metrics.Sample {
+			_, n := s.Stats()
+			return []metrics.Sample{{Value: float64(n)}}
+		})
+}
+
 // ErrFileNotFound indicates that the requested file was not found.
 var ErrFileNotFound = errors.New("file not found")
 
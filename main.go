@@ -4,15 +4,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,14 +31,18 @@ import (
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/metrics"
 	"github.com/knadh/niltalk/internal/upload"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
 	logger = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
 	ko     = koanf.New(".")
+	// koMut guards ko, which is replaced when the config is reloaded.
+	koMut sync.RWMutex
 
 	// Version of the build injected at build time.
 	buildString = "unknown"
@@ -51,7 +60,7 @@ type App struct {
 	qrConfig     qrConfig
 }
 
-func loadConfig() {
+func loadConfig() *flag.FlagSet {
 	// Register --help handler.
 	f := flag.NewFlagSet("config", flag.ContinueOnError)
 	f.Usage = func() {
@@ -66,6 +75,7 @@ func loadConfig() {
 	f.Bool("onionpk", false, "Show the onion private key")
 	f.Bool("version", false, "Show build version")
 	f.Bool("extract-themes", false, "Extract themes assets")
+	f.Bool("hash-password", false, "Hash a predefined user password read from stdin, to put in the config")
 	f.Bool("jit", defaultJIT, "build templates just in time")
 	f.Parse(os.Args[1:])
 
@@ -95,6 +105,22 @@ func loadConfig() {
 		os.Exit(0)
 	}
 
+	// Hash a password.
+	if ok, _ := f.GetBool("hash-password"); ok {
+		pwd, err := readPassword()
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		hash, err := hub.HashPassword(pwd)
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+
 	// Exctrat assets.
 	if ok, _ := f.GetBool("extract-themes"); ok {
 		if err := extractThemes(); err != nil {
@@ -106,6 +132,33 @@ func loadConfig() {
 		os.Exit(0)
 	}
 
+	if err := readConfig(ko, f); err != nil {
+		logger.Fatal(err)
+	}
+	return f
+}
+
+// readPassword reads a password from stdin, without echoing it if stdin is a
+// terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	pwd, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(pwd, "\r\n"), nil
+}
+
+// readConfig reads the config files, the environment and the command line
+// flags into k.
+func readConfig(k *koanf.Koanf, f *flag.FlagSet) error {
 	// Read the config files.
 	cFiles, _ := f.GetStringSlice("config")
 	for _, f := range cFiles {
@@ -113,11 +166,11 @@ func loadConfig() {
 			continue
 		}
 		logger.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
+		if err := k.Load(file.Provider(f), toml.Parser()); err != nil {
 			if os.IsNotExist(err) {
-				logger.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
+				return errors.New("config file not found. If there isn't one yet, run --new-config to generate one.")
 			}
-			logger.Fatalf("error loading config from file: %v.", err)
+			return fmt.Errorf("error loading config from file: %v.", err)
 		}
 	}
 
@@ -127,16 +180,16 @@ func loadConfig() {
 		sampleBox := rice.MustFindBox("static/samples")
 		b, err := sampleBox.Bytes("config.toml")
 		if err != nil {
-			logger.Fatalf("error reading embedded asset %q: %v.", "static/samples/config.toml", err)
+			return fmt.Errorf("error reading embedded asset %q: %v.", "static/samples/config.toml", err)
 		}
-		err = ko.Load(rawbytes.Provider(b), toml.Parser())
+		err = k.Load(rawbytes.Provider(b), toml.Parser())
 		if err != nil {
-			logger.Fatalf("error loading default configuration file: %v.", err)
+			return fmt.Errorf("error loading default configuration file: %v.", err)
 		}
 	}
 
 	// Merge env flags into config.
-	if err := ko.Load(env.Provider("NILTALK_", ".", func(s string) string {
+	if err := k.Load(env.Provider("NILTALK_", ".", func(s string) string {
 		return strings.Replace(strings.ToLower(
 			strings.TrimPrefix(s, "NILTALK_")), "__", ".", -1)
 	}), nil); err != nil {
@@ -144,12 +197,13 @@ func loadConfig() {
 	}
 
 	// Merge command line flags into config.
-	ko.Load(posflag.Provider(f, ".", ko), nil)
+	k.Load(posflag.Provider(f, ".", k), nil)
+	return nil
 }
 
 func main() {
 	// Load configuration from files.
-	loadConfig()
+	flags := loadConfig()
 
 	// Begin listening.
 	lnAddr := ko.String("app.address")
@@ -198,7 +252,8 @@ func main() {
 			logger.Fatalf("could not read or write the private key: %v", err)
 		}
 		fmt.Printf("http://%v.onion\n", onionAddr(pk))
-		return // to allow for defers to execute
+		store.Close()
+		return
 	}
 
 	if ko.Bool("onionpk") {
@@ -211,14 +266,35 @@ func main() {
 			logger.Fatalf("could not PEM encode the private key: %v", err)
 		}
 		fmt.Printf("%s\n", pem)
-		return // to allow for defers to execute
+		store.Close()
+		return
+	}
+
+	var adminCfg adminCfg
+	if err := ko.Unmarshal("admin", &adminCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'admin' config: %v", err)
+	}
+	if adminCfg.Address != "" && adminCfg.Metrics {
+		store = observeStore(store, app.cfg.Storage)
 	}
 
 	app.hub = hub.NewHub(app.cfg, store, logger)
 
-	if err := ko.Unmarshal("rooms", &app.cfg.Rooms); err != nil {
-		logger.Fatalf("error unmarshalling 'rooms' config: %v", err)
+	// Fan out room events to the other instances in cluster mode.
+	if ko.Bool("cluster.enabled") {
+		bus, err := app.makeBus()
+		if err != nil {
+			logger.Fatalf("error initializing cluster bus: %v", err)
+		}
+		app.hub.Bus = bus
+		logger.Printf("cluster mode enabled")
+	}
+
+	rooms, err := configRooms(ko)
+	if err != nil {
+		logger.Fatal(err)
 	}
+	app.cfg.Rooms = rooms
 	// setup predefined rooms
 	err = app.loadPredefinedRooms(themesBox)
 	if err != nil {
@@ -244,6 +320,18 @@ func main() {
 		logger.Fatalf("error initializing upload store: %v", err)
 	}
 
+	// HTTP servers to shut down on exit.
+	var servers []*http.Server
+
+	// Start the admin listener.
+	if adminCfg.Address != "" {
+		if adminCfg.Metrics {
+			app.hub.RegisterMetrics(metrics.Default)
+			uploadStore.RegisterMetrics(metrics.Default)
+		}
+		servers = append(servers, startAdmin(adminCfg, adminRouter(adminCfg, app)))
+	}
+
 	// Register HTTP routes.
 	r := chi.NewRouter()
 	r.Get("/", wrap(handleIndex, app, 0))
@@ -254,7 +342,7 @@ func main() {
 	r.Post("/r/{roomID}/login", wrap(handleLogin, app, hasRoom))
 	r.Delete("/r/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom))
 
-	r.Post("/r/{roomID}/upload", handleUpload(uploadStore))
+	r.Post("/r/{roomID}/upload", wrap(handleUpload(uploadStore), app, hasRoom))
 	r.Get("/r/{roomID}/uploaded/{fileID}", handleUploaded(uploadStore))
 
 	// Views.
@@ -284,6 +372,7 @@ func main() {
 	r.Get("/static/*", noDirListHandler(assets.ServeHTTP))
 
 	// Start the app.
+	var torSrv *torServer
 	if torCfg.Enabled {
 		pk, err := loadTorPK(torCfg, store)
 		if err != nil {
@@ -294,7 +383,7 @@ func main() {
 			PrivateKey: pk,
 			Handler:    r,
 		}
-		defer srv.Close()
+		torSrv = srv
 
 		onionAddr := onionAddr(pk) + ".onion"
 
@@ -305,15 +394,16 @@ func main() {
 		}
 		logger.Printf("starting hidden service on http://%v", onionAddr)
 		go func() {
-			if err := srv.Serve(ln); err != nil {
+			if err := srv.Serve(ln); err != nil && !app.hub.Closing() {
 				logger.Fatalf("couldn't serve: %v", err)
 			}
 		}()
 	}
 
-	srv := http.Server{
+	srv := &http.Server{
 		Handler: r,
 	}
+	servers = append(servers, srv)
 	var sslCfg sslCfg
 	if err := ko.Unmarshal("ssl", &sslCfg); err != nil {
 		logger.Fatalf("error unmarshalling 'ssl' config: %v", err)
@@ -364,7 +454,7 @@ func main() {
 
 	logger.Printf("starting server on http://%v", ln.Addr().String())
 	go func() {
-		if err := srv.Serve(ln); err != nil {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("couldn't serve: %v", err)
 		}
 	}()
@@ -374,9 +464,10 @@ func main() {
 		if err != nil {
 			logger.Fatalf("couldn't listen address %q: %v", sslAddr, err)
 		}
-		ssrv := http.Server{
+		ssrv := &http.Server{
 			Handler: r,
 		}
+		servers = append(servers, ssrv)
 		if sslCfg.Kind == "auto" {
 			ssrv.TLSConfig = tlsConfig(getCertificate(sslCfg.Domains))
 			ssrv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0)
@@ -398,7 +489,7 @@ func main() {
 			} else {
 				err = ssrv.ServeTLS(sln, "", "")
 			}
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				logger.Fatalf("couldn't tls serve: %v", err)
 			}
 		}()
@@ -408,17 +499,25 @@ func main() {
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	var cFiles []string
 	ko.Unmarshal("config", &cFiles)
-	select {
-	case <-fileWatcher(cFiles...):
-	case sig := <-c:
-		logger.Printf("shutting down: %v", sig)
+	watch := fileWatcher(cFiles...)
+loop:
+	for {
+		select {
+		case <-watch:
+			app.reloadConfig(flags, uploadStore)
+		case sig := <-c:
+			logger.Printf("shutting down: %v", sig)
+			break loop
+		}
 	}
-	go func() {
-		d := time.Second * 10
-		<-time.After(d)
-		logger.Printf("%v seconds elapsed. Quiting now.", d)
-		os.Exit(1)
-	}()
+
+	d := app.hub.Config().ShutdownTimeout
+	if d <= 0 {
+		d = time.Second * 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	os.Exit(app.shutdown(ctx, servers, torSrv))
 }
 
 func fileWatcher(files ...string) chan struct{} {
@@ -436,16 +535,29 @@ func fileWatcher(files ...string) chan struct{} {
 			}
 		}
 		go func() {
+			// Editors often write files in several steps, notify once
+			// they're done.
+			var pending *time.Timer
 			for {
 				select {
 				case event, ok := <-watcher.Events:
 					if !ok {
 						return
 					}
-					// if event.Op&fsnotify.Write == fsnotify.Write {
 					logger.Printf("configuration file %q was modified", event.Name)
-					out <- struct{}{}
-					// }
+
+					// The file was replaced, watch the new one.
+					if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+						if err := watcher.Add(event.Name); err != nil {
+							logger.Printf("failed to add configuration file %q watcher: %v", event.Name, err)
+						}
+					}
+					if pending != nil {
+						pending.Stop()
+					}
+					pending = time.AfterFunc(time.Second, func() {
+						out <- struct{}{}
+					})
 				case err, ok := <-watcher.Errors:
 					if !ok {
 						return
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/upload"
+	flag "github.com/spf13/pflag"
+)
+
+// restartKeys are the config keys whose changes can't be applied live.
+var restartKeys = []string{
+	"app.address",
+	"app.storage",
+	"store",
+	"cluster",
+	"admin",
+	"ssl",
+	"tor",
+	"qr",
+}
+
+// reloadConfig reads the configuration again and applies the changes that
+// can be applied live. The others are reported and need a restart. The
+// current configuration is kept if the new one is invalid.
+func (a *App) reloadConfig(flags *flag.FlagSet, uploadStore *upload.Store) {
+	k := koanf.New(".")
+	if err := readConfig(k, flags); err != nil {
+		logger.Printf("error reloading config, keeping the current one: %v", err)
+		return
+	}
+
+	cfg, uploadCfg, err := a.validateConfig(k)
+	if err != nil {
+		logger.Printf("invalid config, keeping the current one: %v", err)
+		return
+	}
+	if err := uploadStore.Reconfigure(uploadCfg); err != nil {
+		logger.Printf("invalid config, keeping the current one: %v", err)
+		return
+	}
+
+	koMut.RLock()
+	old := ko
+	koMut.RUnlock()
+
+	for _, key := range restartKeys {
+		if !reflect.DeepEqual(old.Get(key), k.Get(key)) {
+			logger.Printf("config %q changed, restart to apply it", key)
+		}
+	}
+
+	// Apply the new configuration, keeping what can't change live and the
+	// rooms created through the admin API.
+	var (
+		cur         = a.hub.Config()
+		oldRooms, _ = configRooms(old)
+		newRooms    = make(map[string]hub.PredefinedRoom, len(cfg.Rooms))
+	)
+	cfg.Address = cur.Address
+	cfg.Storage = cur.Storage
+	for id, pr := range cfg.Rooms {
+		newRooms[id] = pr
+	}
+	for id, pr := range a.hub.PredefinedRooms() {
+		if _, ok := oldRooms[id]; !ok {
+			if _, ok := newRooms[id]; !ok {
+				cfg.Rooms[id] = pr
+			}
+		}
+	}
+	a.hub.SetConfig(cfg)
+	koMut.Lock()
+	ko = k
+	koMut.Unlock()
+
+	// Apply the changes of the predefined rooms.
+	for id := range oldRooms {
+		if _, ok := newRooms[id]; !ok {
+			logger.Printf("removing predefined room %q", id)
+			a.hub.DisposeRoom(id)
+		}
+	}
+	for id, pr := range newRooms {
+		old, ok := oldRooms[id]
+		if !ok {
+			logger.Printf("adding predefined room %q", id)
+			a.addPredefinedRoom(pr, a.themesBox)
+			continue
+		}
+		if reflect.DeepEqual(old, pr) {
+			continue
+		}
+
+		logger.Printf("updating predefined room %q", id)
+		growl, err := a.makeGrowlHandler(pr, a.themesBox)
+		if err != nil {
+			continue
+		}
+		if err := a.hub.ReconfigureRoom(pr, growl); err == hub.ErrRoomNotFound {
+			a.addPredefinedRoom(pr, a.themesBox)
+		}
+	}
+
+	logger.Printf("config reloaded")
+}
+
+// validateConfig reads and checks the app, rooms and upload configuration.
+// The predefined rooms of the returned config are keyed by ID.
+func (a *App) validateConfig(k *koanf.Koanf) (*hub.Config, upload.Config, error) {
+	var (
+		cfg       hub.Config
+		uploadCfg upload.Config
+	)
+	if err := k.Unmarshal("app", &cfg); err != nil {
+		return nil, uploadCfg, fmt.Errorf("error unmarshalling 'app' config: %v", err)
+	}
+	if err := k.Unmarshal("upload", &uploadCfg); err != nil {
+		return nil, uploadCfg, fmt.Errorf("error unmarshalling 'upload' config: %v", err)
+	}
+	rooms, err := configRooms(k)
+	if err != nil {
+		return nil, uploadCfg, err
+	}
+	cfg.Rooms = rooms
+
+	minTime := time.Duration(3) * time.Second
+	if cfg.RoomAge < minTime || cfg.WSTimeout < minTime {
+		return nil, uploadCfg, errors.New("app.websocket_timeout and app.roomage should be > 3s")
+	}
+	if cfg.Theme == "" {
+		cfg.Theme = "knadh"
+	}
+	if _, ok := a.tpls[cfg.Theme]; !ok {
+		return nil, uploadCfg, fmt.Errorf("theme %q not found", cfg.Theme)
+	}
+	return &cfg, uploadCfg, nil
+}
+
+// configRooms returns the predefined rooms of a configuration, by ID.
+func configRooms(k *koanf.Koanf) (map[string]hub.PredefinedRoom, error) {
+	var rooms map[string]hub.PredefinedRoom
+	if err := k.Unmarshal("rooms", &rooms); err != nil {
+		return nil, fmt.Errorf("error unmarshalling 'rooms' config: %v", err)
+	}
+	out := make(map[string]hub.PredefinedRoom, len(rooms))
+	for _, r := range rooms {
+		for _, u := range r.Users {
+			if err := hub.ValidatePasswordHash(u.Password); err != nil {
+				return nil, fmt.Errorf("the password hash of user %q of room %q is invalid: %v", u.Name, r.ID, err)
+			}
+			if u.Password != "" && !hub.IsPasswordHash(u.Password) {
+				logger.Printf("the password of user %q of room %q is in plain text, hash it with --hash-password", u.Name, r.ID)
+			}
+		}
+		out[r.ID] = r
+	}
+	return out, nil
+}
@@ -9,36 +9,50 @@ import (
 // loadPredefinedRooms loads into curet hub the given list of predefind rooms.
 // It must be called before starting the app and is not safe for concurrent use.
 func (a *App) loadPredefinedRooms(assetBox *rice.Box) error {
-	rooms := a.cfg.Rooms
-	localURL := "http://" + a.localAddress
-	for _, room := range rooms {
-		r, err := a.hub.AddPredefinedRoom(room.ID, room.Name, room.Password)
-		if err != nil {
-			a.logger.Printf("error creating a predefined room %q: %v", room.Name, err)
-			continue
-		}
-		r.PredefinedUsers = make([]hub.PredefinedUser, len(room.Users), len(room.Users))
-		copy(r.PredefinedUsers, room.Users)
-		var growl bool
-		for _, u := range r.PredefinedUsers {
-			if u.Growl {
-				growl = true
-				break
-			}
-		}
-		if growl {
-			n := notify.New(room.Growl, localURL, r.ID, a.logger, assetBox)
-			if err = n.Init(); err != nil {
-				a.logger.Printf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
-				continue
-			}
-			r.GrowlHandler = n.OnGrowlMessage
-		}
-		_, err = a.hub.ActivateRoom(r.ID)
-		if err != nil {
-			a.logger.Printf("error activating a predefined room %q: %v", room.Name, err)
-			continue
+	for _, room := range a.cfg.Rooms {
+		// Errors are logged, the other rooms are still loaded.
+		a.addPredefinedRoom(room, assetBox)
+	}
+	return nil
+}
+
+// makeGrowlHandler returns the growl notification handler of a predefined room,
+// nil if none of its users growls.
+func (a *App) makeGrowlHandler(room hub.PredefinedRoom, assetBox *rice.Box) (hub.GrowlFunc, error) {
+	users := make(map[string]notify.UserOptions)
+	for _, u := range room.Users {
+		if u.Growl {
+			users[u.Name] = u.Notify
 		}
 	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	n := notify.New(room.Growl, users, "http://"+a.localAddress, room.ID, a.logger, assetBox)
+	if err := n.Init(); err != nil {
+		a.logger.Printf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
+		return nil, err
+	}
+	return n.OnGrowlMessage, nil
+}
+
+// addPredefinedRoom adds a predefined room to the hub and activates it.
+func (a *App) addPredefinedRoom(room hub.PredefinedRoom, assetBox *rice.Box) error {
+	r, err := a.hub.AddPredefinedRoom(room.ID, room.Name, room.Password)
+	if err != nil {
+		a.logger.Printf("error creating a predefined room %q: %v", room.Name, err)
+		return err
+	}
+	growl, err := a.makeGrowlHandler(room, assetBox)
+	if err != nil {
+		return err
+	}
+	r.SetPredefinedUsers(room.Users, growl)
+	_, err = a.hub.ActivateRoom(r.ID)
+	if err != nil {
+		a.logger.Printf("error activating a predefined room %q: %v", room.Name, err)
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// shutdown stops the app within the context's deadline: the hub disconnects
+// the peers and stops accepting new rooms and sessions, then the servers,
+// the cluster bus and the store are closed. It returns the exit status.
+func (a *App) shutdown(ctx context.Context, servers []*http.Server, tor *torServer) int {
+	status := 0
+
+	if err := a.hub.Shutdown(ctx); err != nil {
+		a.logger.Printf("error shutting down rooms: %v", err)
+		status = 1
+	}
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			a.logger.Printf("error shutting down server: %v", err)
+			status = 1
+		}
+	}
+	if tor != nil {
+		if err := tor.Shutdown(ctx); err != nil {
+			a.logger.Printf("error shutting down hidden service: %v", err)
+			status = 1
+		}
+	}
+
+	if a.hub.Bus != nil {
+		if err := a.hub.Bus.Close(); err != nil {
+			a.logger.Printf("error closing cluster bus: %v", err)
+			status = 1
+		}
+	}
+	if err := a.hub.Store.Close(); err != nil {
+		a.logger.Printf("error closing store: %v", err)
+		status = 1
+	}
+
+	if status == 0 {
+		a.logger.Printf("shutdown complete")
+	}
+	return status
+}
@@ -4,6 +4,18 @@ const notifType = {
     error: "error"
 };
 const typingDebounceInterval = 3000;
+const reactionEmojis = ["👍", "❤️", "😂", "😮", "😢", "🎉"];
+const readReceiptsKey = "niltalk_read_receipts";
+const readDebounceInterval = 1000;
+const expirySweepInterval = 5000;
+
+// Lifetimes a sender can give their messages, in seconds.
+const messageLifetimes = [
+    { label: "Keep", ttl: 0 },
+    { label: "1 min", ttl: 60 },
+    { label: "1 hour", ttl: 3600 },
+    { label: "1 day", ttl: 86400 }
+];
 
 Vue.component("expand-link", {
     props: ["link"],
@@ -12,6 +24,12 @@ Vue.component("expand-link", {
             visible: false
         }
     },
+    computed: {
+        // The link keeps the URL fragment, the key of an encrypted room.
+        url() {
+            return this.link + document.location.hash;
+        }
+    },
     methods: {
         select(e) {
             e.target.select();
@@ -20,7 +38,7 @@ Vue.component("expand-link", {
     template: `
         <div class="expand-link">
             <a href="#" v-on:click.prevent="visible = !visible">🔗</a>
-            <input v-if="visible" v-on:click="select" readonly type="text" :value="link" />
+            <input v-if="visible" v-on:click="select" readonly type="text" :value="url" />
         </div>
     `
 });
@@ -42,8 +60,47 @@ var commands = {
     "help": "Show commands help",
     "usage": "/help [command]?",
   },
+  "kick": {
+    "help": "Disconnect an user from the room",
+    "usage": "/kick [user]",
+  },
+  "ban": {
+    "help": "Disconnect an user and prevent it from joining again",
+    "usage": "/ban [user]",
+  },
+  "mute": {
+    "help": "Make an user read-only",
+    "usage": "/mute [user]",
+  },
+  "unmute": {
+    "help": "Let a muted user write again",
+    "usage": "/unmute [user]",
+  },
+  "promote": {
+    "help": "Make an user a moderator of the room",
+    "usage": "/promote [user]",
+  },
+  "demote": {
+    "help": "Remove the moderator role of an user",
+    "usage": "/demote [user]",
+  },
+  "topic": {
+    "help": "Set the topic of the room, or clear it",
+    "usage": "/topic [text]?",
+  },
+  "nick": {
+    "help": "Change your handle",
+    "usage": "/nick [handle]",
+  },
 }
 
+const moderationNotices = {
+  "peer.kicked": "was kicked by",
+  "peer.banned": "was banned by",
+  "peer.muted": "was muted by",
+  "peer.unmuted": "was unmuted by",
+};
+
 // throw it at startup, though you will need an ssl certificate.
 Notify.requestPermission(null, null);
 
@@ -75,6 +132,7 @@ var app = new Vue({
 
         // Form fields.
         roomName: "",
+        encrypted: false,
         handle: "",
         password: "",
         userpwd: "",
@@ -85,6 +143,32 @@ var app = new Vue({
         messages: [],
         peers: [],
 
+        // Message being replied to, and the reply thread shown in the sidebar.
+        replyTo: null,
+        thread: null,
+        reactionEmojis: reactionEmojis,
+
+        // Lifetime given to the messages sent, in seconds.
+        messageLifetimes: messageLifetimes,
+        messageTTL: 0,
+
+        // Read markers of the peers by peer ID, and whether to send ours.
+        readMarks: {},
+        readReceipts: localStorage.getItem(readReceiptsKey) === "1",
+        readTimer: null,
+        readSeq: 0,
+
+        // Public keys announced by the peers of an encrypted room, by peer
+        // ID. They're kept after the peers leave to verify their messages.
+        peerKeys: {},
+
+        // IDs of the messages mentioning this peer that are yet to arrive.
+        pendingMentions: {},
+
+        // Topic of the room and its pinned messages.
+        topic: {},
+        pins: [],
+
         // upload
         isDraggingOver: false,
     },
@@ -94,8 +178,7 @@ var app = new Vue({
 
         if (window.hasOwnProperty("_room") && _room.auth) {
             this.toggleChat();
-            Client.init(_room.id);
-            Client.connect();
+            this.connect();
         }
     },
     computed: {
@@ -106,11 +189,16 @@ var app = new Vue({
     methods: {
         // Handle room creation.
         handleCreateRoom() {
+            if (this.encrypted && !E2E.available()) {
+                this.notify("Encrypted rooms need a secure (https) connection", notifType.error);
+                return;
+            }
             fetch("/api/rooms", {
                 method: "post",
                 body: JSON.stringify({
                     name: this.roomName,
-                    password: this.password
+                    password: this.password,
+                    encrypted: this.encrypted
                 }),
                 headers: { "Content-Type": "application/json; charset=utf-8" }
             })
@@ -120,7 +208,10 @@ var app = new Vue({
                     if (resp.error) {
                         this.notify(resp.error, notifType.error);
                     } else {
-                        document.location.replace("/r/" + resp.data.id);
+                        // The secret of an encrypted room stays in the URL
+                        // fragment, that's never sent to the server.
+                        document.location.replace("/r/" + resp.data.id +
+                            (this.encrypted ? "#" + E2E.newSecret() : ""));
                     }
                 })
                 .catch(err => {
@@ -151,8 +242,7 @@ var app = new Vue({
                     this.clear();
                     this.deNotify();
                     this.toggleChat();
-                    Client.init(_room.id);
-                    Client.connect();
+                    this.connect();
                 })
                 .catch(err => {
                     this.toggleBusy();
@@ -160,6 +250,63 @@ var app = new Vue({
                 });
         },
 
+        // Connect to the room, deriving the room key first if it's
+        // encrypted.
+        connect() {
+            if (!_room.encrypted) {
+                Client.init(_room.id);
+                Client.connect();
+                return;
+            }
+
+            const secret = document.location.hash.slice(1);
+            if (!E2E.available() || !secret) {
+                this.notify(!secret ? "This room is encrypted, open it with its full link" :
+                    "Encrypted rooms need a secure (https) connection", notifType.error, 10000);
+                return;
+            }
+
+            // The history is sent before the peer list, hold off decrypting
+            // it until the peers' keys are known.
+            this.keysReady = new Promise((resolve) => { this.keysLoaded = resolve; });
+            E2E.init(secret, _room.id)
+                .then(() => {
+                    Client.init(_room.id, E2E.publicKey);
+                    Client.connect();
+                })
+                .catch((err) => {
+                    this.notify("Error deriving the room key: " + err, notifType.error, 10000);
+                });
+        },
+
+        // Encrypt a message in an encrypted room.
+        seal(text) {
+            if (!_room.encrypted || !text) {
+                return Promise.resolve(text);
+            }
+            return E2E.encrypt(text);
+        },
+
+        // Set the text of a message, decrypting it in an encrypted room.
+        // The message is updated in place once it's decrypted so that it
+        // keeps its position.
+        reveal(m, text, peerID) {
+            if (!_room.encrypted || !text) {
+                m.message = text;
+                return;
+            }
+            m.message = "";
+            this.keysReady
+                .then(() => E2E.decrypt(text, this.peerKeys[peerID]))
+                .then((r) => {
+                    m.message = r.text;
+                    m.unverified = !r.verified;
+                })
+                .catch(() => {
+                    m.undecryptable = true;
+                });
+        },
+
         // Capture keypresses to send message on Enter key and to broadcast
         // "typing" statuses.
         handleChatKeyPress(e) {
@@ -197,18 +344,37 @@ var app = new Vue({
           }
           this.message = "";
 
-          //lookup for a command
+          // lookup for a command. The server runs the commands, except in
+          // encrypted rooms whose messages it can't read.
           var commandName = "";
-          Object.keys(commands).map((key)=>{
-            var re = new RegExp("^(/"+key+")(\\s+|$)");
-            if (msg.match(re)) {
-              commandName = key
-            }
-          });
+          if (_room.encrypted) {
+            Object.keys(commands).map((key)=>{
+              var re = new RegExp("^(/"+key+")(\\s+|$)");
+              if (msg.match(re)) {
+                commandName = key
+              }
+            });
+          }
 
           // no command provided, handle a regular message
           if (commandName.length<1) {
-            Client.sendMessage(Client.MsgType["message"], msg);
+            const replyTo = this.replyTo,
+              ttl = this.messageTTL;
+            this.replyTo = null;
+            this.seal(msg).then((msg) => {
+              if (!replyTo && !ttl) {
+                Client.sendMessage(Client.MsgType["message"], msg);
+                return;
+              }
+              const d = {message: msg};
+              if (replyTo) {
+                d.reply_to = replyTo.id;
+              }
+              if (ttl) {
+                d.ttl = ttl;
+              }
+              Client.sendMessage(Client.MsgType["message"], d);
+            });
 
           }else if (commandName=="help"){
             var message = "";
@@ -240,13 +406,38 @@ var app = new Vue({
           }else if (commandName=="ping"){
             var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)(\\s+.*)?");
             var matches = msg.match(re);
-            Client.sendMessage(Client.MsgType["ping"], {to:matches[2], msg:matches[3],from: this.self.handle});
+            this.seal(matches[3]).then((msg) => {
+              Client.sendMessage(Client.MsgType["ping"], {to:matches[2], msg:msg,from: this.self.handle, ref: Date.now().toString(36)});
+            });
 
           }else if (commandName=="whisper"){
             var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)(\\s+.*)?");
             var matches = msg.match(re);
-            Client.sendMessage(Client.MsgType["whisper"], {to:matches[2], msg:matches[3],from: this.self.handle});
+            this.seal(matches[3]).then((msg) => {
+              Client.sendMessage(Client.MsgType["whisper"], {to:matches[2], msg:msg,from: this.self.handle, ref: Date.now().toString(36)});
+            });
 
+          }else if (["kick", "ban", "mute", "unmute", "promote", "demote"].includes(commandName)){
+            var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)");
+            var matches = msg.match(re);
+            if (matches) {
+              Client.sendMessage(Client.MsgType["peer."+commandName], {handle:matches[2]});
+            }
+
+          }else if (commandName=="nick"){
+            var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)");
+            var matches = msg.match(re);
+            if (matches) {
+              Client.sendMessage(Client.MsgType["handle"], {handle:matches[2]});
+            }
+
+          }else if (commandName=="topic"){
+            var re = new RegExp("^(/"+commandName+")(\\s+.*)?");
+            var matches = msg.match(re);
+            var topic = (matches[2] || "").trim();
+            (topic ? this.seal(topic) : Promise.resolve("")).then((topic) => {
+              Client.sendMessage(Client.MsgType["room.topic"], {topic:topic});
+            });
           }
         },
 
@@ -468,6 +659,14 @@ var app = new Vue({
             this.self = {};
             this.messages = [];
             this.peers = [];
+            this.replyTo = null;
+            this.thread = null;
+            this.readMarks = {};
+            this.readSeq = 0;
+            this.peerKeys = {};
+            this.pendingMentions = {};
+            this.topic = {};
+            this.pins = [];
         },
 
         // WebSocket client event handlers.
@@ -496,10 +695,92 @@ var app = new Vue({
                     this.toggleChat();
                     this.disposed = true;
                     break;
+
+                case Client.MsgType["peer.kicked"]:
+                    this.notify("You were kicked out of the room", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["peer.banned"]:
+                    this.notify("You are banned from this room", notifType.error);
+                    this.toggleChat();
+                    break;
             }
             // window.location.reload();
         },
 
+        // Moderation notices. Without data, the moderation targets this
+        // peer and closed its connection.
+        onModeration(data, typ) {
+            if (!data) {
+                this.onDisconnect(typ);
+                return;
+            }
+            this.messages.push({
+                type: Client.MsgType["notice"],
+                message: data.data.peer_handle + " " + moderationNotices[typ] + " " + data.data.by_handle,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        onRole(data) {
+            const peer = data.data;
+            if (peer.id === this.self.id) {
+                this.self = { ...this.self, role: peer.role };
+            }
+            this.onPeers(this.peers.map((p) => {
+                return p.id === peer.id ? { ...p, role: peer.role } : p;
+            }));
+
+            this.messages.push({
+                type: Client.MsgType["notice"],
+                message: peer.handle + " is now " + (peer.role || "a regular peer"),
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        // A peer changed its handle. Its messages are shown with the new one.
+        onHandle(data) {
+            const d = data.data;
+            if (d.peer_id === this.self.id) {
+                this.self = { ...this.self, handle: d.peer_handle };
+            }
+            this.onPeers(this.peers.map((p) => {
+                return p.id === d.peer_id ? { ...p, handle: d.peer_handle } : p;
+            }));
+            this.messages.map((m) => {
+                if (m.peer && m.peer.id === d.peer_id) {
+                    m.peer.handle = d.peer_handle;
+                }
+            });
+            if (this.readMarks[d.peer_id]) {
+                this.readMarks[d.peer_id].peer_handle = d.peer_handle;
+            }
+
+            this.messages.push({
+                type: Client.MsgType["notice"],
+                message: d.old_handle + " is now known as " + d.peer_handle,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        // Output of a command, shown to this peer only.
+        onCommandOutput(data) {
+            this.messages.push({
+                type: Client.MsgType["command.output"],
+                message: data.data,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        onNotice(data) {
+            this.notify(data.data, notifType.error);
+        },
+
         onReconnecting(timeout) {
             this.notify("Disconnected. Retrying ...", notifType.notice, timeout);
         },
@@ -520,6 +801,7 @@ var app = new Vue({
                 peers.push(peer);
             } else {
                 peers = peers.filter((e) => { return e.id !== peer.id; });
+                Vue.delete(this.readMarks, peer.id);
             }
             this.onPeers(peers);
 
@@ -548,6 +830,9 @@ var app = new Vue({
 
             peers.forEach(p => {
                 p.avatar = this.hashColor(p.id);
+                if (p.key) {
+                    this.peerKeys[p.id] = p.key;
+                }
             });
 
             this.peers = peers;
@@ -563,17 +848,35 @@ var app = new Vue({
 
         onMessage(data) {
             this.typingPeers.delete(data.data.peer_id);
-            this.messages.push({
+            const m = {
                 type: data.type,
                 timestamp: data.timestamp,
+                id: data.data.id,
                 message: data.data.message,
+                unverified: false,
+                undecryptable: false,
+                edited: data.data.edited,
+                deleted: data.data.deleted,
+                action: data.data.action,
+                mentioned: !!this.pendingMentions[data.data.id],
+                replyTo: data.data.reply_to,
+                expiresAt: data.data.expires_at,
+                reactions: {},
+                picking: false,
+                seq: data.seq,
                 peer: {
                     id: data.data.peer_id,
                     handle: data.data.peer_handle,
                     avatar: this.hashColor(data.data.peer_id)
                 }
-            });
+            };
+            Vue.delete(this.pendingMentions, data.data.id);
+            this.messages.push(m);
+            if (data.type === Client.MsgType["message"]) {
+                this.reveal(m, data.data.message, data.data.peer_id);
+            }
             this.scrollToNewester();
+            this.markRead();
             // If the window isn't in focus, start the "new activity" animation
             // in the title bar.
             if (!document.hasFocus()) {
@@ -582,6 +885,261 @@ var app = new Vue({
             }
         },
 
+        // A message was edited or deleted.
+        onMessageEdit(data, typ) {
+            const m = this.messages.find((m) => m.id && m.id === data.data.id);
+            if (!m) {
+                return;
+            }
+            if (typ === Client.MsgType["message.delete"]) {
+                m.message = "";
+                m.deleted = true;
+                this.messages.map((r) => {
+                    if (r.replyTo && r.replyTo.id === m.id) {
+                        r.replyTo.excerpt = "";
+                    }
+                });
+            } else {
+                this.reveal(m, data.data.message, m.peer.id);
+                m.edited = true;
+            }
+        },
+
+        // A message reached the end of its lifetime.
+        onMessageExpired(data) {
+            this.removeMessages((m) => m.id === data.data.id);
+        },
+
+        // Remove the messages matching the filter, from the thread too.
+        removeMessages(match) {
+            this.messages = this.messages.filter((m) => !match(m));
+            if (this.thread) {
+                this.thread.messages = this.thread.messages.filter((m) => !match(m));
+            }
+            if (this.replyTo && match(this.replyTo)) {
+                this.replyTo = null;
+            }
+        },
+
+        // Whether the peer can edit or delete a message. The server checks
+        // the moderators' ranks.
+        canChangeMessage(m) {
+            return m.id && !m.deleted &&
+                (m.peer.id === this.self.id || ["moderator", "owner"].includes(this.self.role));
+        },
+
+        handleEditMessage(m) {
+            const msg = prompt("Edit message", m.message);
+            if (msg === null || msg.trim().length < 1 || msg === m.message) {
+                return;
+            }
+            this.seal(msg.trim()).then((msg) => {
+                Client.sendMessage(Client.MsgType["message.edit"], { id: m.id, message: msg });
+            });
+        },
+
+        // Add or remove a reaction of the peer to a message.
+        handleReact(m, emoji) {
+            m.picking = false;
+            Client.sendMessage(Client.MsgType["reaction"], { id: m.id, emoji: emoji });
+        },
+
+        onReaction(data) {
+            const d = data.data;
+            const m = this.messages.find((m) => m.id && m.id === d.id);
+            if (!m) {
+                return;
+            }
+            let peers = (m.reactions[d.emoji] || []).filter((p) => p !== d.peer_id);
+            if (!d.removed) {
+                peers.push(d.peer_id);
+            }
+            if (peers.length > 0) {
+                Vue.set(m.reactions, d.emoji, peers);
+            } else {
+                Vue.delete(m.reactions, d.emoji);
+            }
+        },
+
+        // Current reactions to the messages, sent on joining.
+        onReactions(data) {
+            this.messages.map((m) => {
+                if (m.id && data.data[m.id]) {
+                    m.reactions = { ...data.data[m.id] };
+                }
+            });
+        },
+
+        // Acknowledgement of a whisper or a ping.
+        onDelivery(data, typ) {
+            const d = data.data;
+            if (typ === Client.MsgType["undelivered"]) {
+                this.notify(d.to + ": " + d.error, notifType.error);
+                return;
+            }
+            if (d.queued) {
+                this.notify(d.to + " is offline, queued for their next login", notifType.notice);
+                return;
+            }
+            this.notify("Delivered to " + d.to, notifType.notice);
+        },
+
+        // Send the sequence ID of the last payload read, if read receipts
+        // are on and the window is in focus.
+        markRead() {
+            if (!this.readReceipts || this.readTimer || !document.hasFocus()) {
+                return;
+            }
+            this.readTimer = window.setTimeout(() => {
+                this.readTimer = null;
+                const seq = Client.lastSeq();
+                if (seq > this.readSeq) {
+                    this.readSeq = seq;
+                    Client.sendMessage(Client.MsgType["read"], { seq: seq });
+                }
+            }, readDebounceInterval);
+        },
+
+        toggleReadReceipts() {
+            this.readReceipts = !this.readReceipts;
+            localStorage.setItem(readReceiptsKey, this.readReceipts ? "1" : "0");
+            this.markRead();
+        },
+
+        onRead(data) {
+            Vue.set(this.readMarks, data.data.peer_id, data.data);
+        },
+
+        onReadList(data) {
+            data.data.map((m) => { Vue.set(this.readMarks, m.peer_id, m); });
+        },
+
+        // Handles of the peers whose last read payload is the message at
+        // the given index, or one before the next message.
+        seenBy(i) {
+            const m = this.messages[i];
+            if (!m.seq) {
+                return [];
+            }
+            const next = this.messages.slice(i + 1).find((n) => n.seq);
+            return Object.values(this.readMarks).filter((r) => {
+                return r.peer_id !== this.self.id && r.seq >= m.seq && (!next || r.seq < next.seq);
+            }).map((r) => r.peer_handle);
+        },
+
+        handleReply(m) {
+            this.replyTo = m;
+            this.$refs["form-message"].focus();
+        },
+
+        // Request the messages of a thread to show them in the sidebar.
+        handleShowThread(id) {
+            Client.sendMessage(Client.MsgType["thread"], { id: id });
+        },
+
+        onThread(data) {
+            this.thread = {
+                id: data.data.id,
+                messages: data.data.messages.map((m) => {
+                    return {
+                        id: m.data.id,
+                        expiresAt: m.data.expires_at,
+                        timestamp: m.timestamp,
+                        message: "",
+                        unverified: false,
+                        undecryptable: false,
+                        deleted: m.data.deleted,
+                        peer: {
+                            handle: m.data.peer_handle,
+                            avatar: this.hashColor(m.data.peer_id)
+                        }
+                    };
+                })
+            };
+            this.thread.messages.map((m, i) => {
+                const d = data.data.messages[i].data;
+                this.reveal(m, d.message, d.peer_id);
+            });
+            this.sidebarOn = true;
+        },
+
+        // Excerpt of the message replied to. In an encrypted room the server
+        // can't quote it, so it's taken from the decrypted message.
+        quoteExcerpt(q) {
+            if (q.excerpt || !_room.encrypted) {
+                return q.excerpt;
+            }
+            const m = this.messages.find((m) => m.id === q.id);
+            if (!m || m.deleted || !m.message) {
+                return "";
+            }
+            return m.message.length > 100 ? m.message.slice(0, 100) + "…" : m.message;
+        },
+
+        // Whether the peer can change the topic and the pins of the room.
+        canEditRoom() {
+            return ["moderator", "owner"].includes(this.self.role);
+        },
+
+        onTopic(data) {
+            const t = { message: "" };
+            this.reveal(t, data.data.topic, "");
+            this.topic = t;
+            if (data.data.by_handle) {
+                this.messages.push({
+                    type: Client.MsgType["notice"],
+                    message: data.data.by_handle + (data.data.topic ? " changed the topic" : " cleared the topic"),
+                    timestamp: data.timestamp
+                });
+                this.scrollToNewester();
+            }
+        },
+
+        onPins(data) {
+            this.pins = data.data.messages.map((p) => {
+                const m = {
+                    id: p.data.id,
+                    timestamp: p.timestamp,
+                    message: "",
+                    unverified: false,
+                    undecryptable: false,
+                    peer: {
+                        handle: p.data.peer_handle,
+                        avatar: this.hashColor(p.data.peer_id)
+                    }
+                };
+                this.reveal(m, p.data.message, p.data.peer_id);
+                return m;
+            });
+            if (data.data.by_handle) {
+                this.messages.push({
+                    type: Client.MsgType["notice"],
+                    message: data.data.by_handle + " changed the pinned messages",
+                    timestamp: data.timestamp
+                });
+                this.scrollToNewester();
+            }
+        },
+
+        handlePin(m) {
+            Client.sendMessage(Client.MsgType["message.pin"], { id: m.id });
+        },
+
+        handleUnpin(m) {
+            Client.sendMessage(Client.MsgType["message.unpin"], { id: m.id });
+        },
+
+        isPinned(m) {
+            return this.pins.some((p) => p.id === m.id);
+        },
+
+        handleDeleteMessage(m) {
+            if (!confirm("Delete this message?")) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType["message.delete"], { id: m.id });
+        },
+
         onUpload(data) {
           var d = data.data.data;
           if (data.type==Client.MsgType["uploading"]) {
@@ -646,10 +1204,43 @@ var app = new Vue({
 
         onPing(data) {
           if (!document.hasFocus()) {
-            var from = data.data.data.from;
             var msg = data.data.data.msg;
             if(!msg){return}
 
+            if (_room.encrypted) {
+              this.keysReady
+                .then(() => E2E.decrypt(msg, this.peerKeys[data.data.peer_id]))
+                .then((r) => { this.showPing(data, r.text); })
+                .catch(() => {});
+              return;
+            }
+            this.showPing(data, msg);
+          }
+        },
+
+        // A message mentions this peer. The highlight can arrive before the
+        // message itself.
+        onMention(data) {
+            const m = this.messages.find((m) => m.id && m.id === data.data.id);
+            if (m) {
+                m.mentioned = true;
+            } else {
+                Vue.set(this.pendingMentions, data.data.id, true);
+            }
+            if (!document.hasFocus()) {
+                if (!Notify.needsPermission) {
+                    new Notify(data.data.peer_handle + " mentioned you", {
+                        tag: $.uniqueId(),
+                        timeout: 4
+                    }).show();
+                }
+                this.newActivity = true;
+                this.beep();
+            }
+        },
+
+        showPing(data, msg) {
+            var from = data.data.data.from;
             if (!Notify.needsPermission) {
               var title = from+" pings you!";
               new Notify(title, {
@@ -672,22 +1263,25 @@ var app = new Vue({
               this.newActivity = true;
               this.beep();
             }
-          }
         },
 
         onWhisper(data) {
           var msg = data.data.data.msg;
           if (msg) {
-            this.messages.push({
+            const m = {
               type: Client.MsgType["whisper"],
-              message: msg,
+              message: "",
+              unverified: false,
+              undecryptable: false,
               timestamp: data.timestamp,
               peer: {
                   id: data.data.peer_id,
                   handle: data.data.peer_handle,
                   avatar: this.hashColor(data.data.peer_id)
               }
-            });
+            };
+            this.messages.push(m);
+            this.reveal(m, msg, data.data.peer_id);
             this.scrollToNewester();
             if (!document.hasFocus()) {
               this.newActivity = true;
@@ -706,7 +1300,12 @@ var app = new Vue({
             Client.on(Client.MsgType["reconnecting"], this.onReconnecting);
 
             Client.on(Client.MsgType["peer.info"], this.onPeerSelf);
-            Client.on(Client.MsgType["peer.list"], (data) => { this.onPeers(data.data); });
+            Client.on(Client.MsgType["peer.list"], (data) => {
+                this.onPeers(data.data);
+                if (this.keysLoaded) {
+                    this.keysLoaded();
+                }
+            });
             Client.on(Client.MsgType["peer.join"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.join"]); });
             Client.on(Client.MsgType["peer.leave"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.leave"]); });
             Client.on(Client.MsgType["message"], this.onMessage);
@@ -716,6 +1315,26 @@ var app = new Vue({
             Client.on(Client.MsgType["typing"], this.onTyping);
             Client.on(Client.MsgType["ping"], this.onPing);
             Client.on(Client.MsgType["whisper"], this.onWhisper);
+            Client.on(Client.MsgType["notice"], this.onNotice);
+            Client.on(Client.MsgType["peer.role"], this.onRole);
+            Client.on(Client.MsgType["handle"], this.onHandle);
+            Client.on(Client.MsgType["message.edit"], (data) => { this.onMessageEdit(data, Client.MsgType["message.edit"]); });
+            Client.on(Client.MsgType["message.delete"], (data) => { this.onMessageEdit(data, Client.MsgType["message.delete"]); });
+            Client.on(Client.MsgType["thread"], this.onThread);
+            Client.on(Client.MsgType["reaction"], this.onReaction);
+            Client.on(Client.MsgType["reactions"], this.onReactions);
+            Client.on(Client.MsgType["delivered"], (data) => { this.onDelivery(data, Client.MsgType["delivered"]); });
+            Client.on(Client.MsgType["undelivered"], (data) => { this.onDelivery(data, Client.MsgType["undelivered"]); });
+            Client.on(Client.MsgType["read"], this.onRead);
+            Client.on(Client.MsgType["read.list"], this.onReadList);
+            Client.on(Client.MsgType["message.expired"], this.onMessageExpired);
+            Client.on(Client.MsgType["room.topic"], this.onTopic);
+            Client.on(Client.MsgType["pins"], this.onPins);
+            Client.on(Client.MsgType["command.output"], this.onCommandOutput);
+            Client.on(Client.MsgType["mention"], this.onMention);
+            Object.keys(moderationNotices).map((typ) => {
+                Client.on(Client.MsgType[typ], (data) => { this.onModeration(data, typ); });
+            });
         },
 
         initTimers() {
@@ -734,8 +1353,18 @@ var app = new Vue({
             window.onfocus = () => {
                 this.newActivity = false;
                 document.title = this.pageTitle;
+                this.markRead();
             };
 
+            // Remove the messages at the end of their lifetime, in case the
+            // server's notice was missed while disconnected.
+            window.setInterval(() => {
+                const now = Date.now();
+                if (this.messages.some((m) => m.expiresAt && Date.parse(m.expiresAt) <= now)) {
+                    this.removeMessages((m) => m.expiresAt && Date.parse(m.expiresAt) <= now);
+                }
+            }, expirySweepInterval);
+
             // Sweep "typing" statuses at regular intervals.
             window.setInterval(() => {
                 let changed = false;
@@ -762,6 +1391,10 @@ var app = new Vue({
         // image upload
         addFile(e) {
           this.isDraggingOver=false
+          if (_room.encrypted) {
+            this.notify("Uploads are disabled in encrypted rooms", notifType.error);
+            return;
+          }
           // based on https://www.raymondcamden.com/2019/08/08/drag-and-drop-file-upload-in-vuejs
           let droppedFiles = e.dataTransfer.files;
           if(!droppedFiles) return;
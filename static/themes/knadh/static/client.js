@@ -20,11 +20,41 @@ var Client = new function () {
 		"ping": "ping",
 		"whisper": "whisper",
 		"motd": "motd",
-		"help": "help"
+		"help": "help",
+		"peer.kick": "peer.kick",
+		"peer.ban": "peer.ban",
+		"peer.mute": "peer.mute",
+		"peer.unmute": "peer.unmute",
+		"peer.kicked": "peer.kicked",
+		"peer.banned": "peer.banned",
+		"peer.muted": "peer.muted",
+		"peer.unmuted": "peer.unmuted",
+		"peer.promote": "peer.promote",
+		"peer.demote": "peer.demote",
+		"peer.role": "peer.role",
+		"server.restart": "server.restart",
+		"message.edit": "message.edit",
+		"message.delete": "message.delete",
+		"thread": "thread",
+		"reaction": "reaction",
+		"reactions": "reactions",
+		"delivered": "delivered",
+		"undelivered": "undelivered",
+		"read": "read",
+		"read.list": "read.list",
+		"message.expired": "message.expired",
+		"room.topic": "room.topic",
+		"message.pin": "message.pin",
+		"message.unpin": "message.unpin",
+		"pins": "pins",
+		"command.output": "command.output",
+		"mention": "mention"
 	};
 	this.MsgType = MsgType;
 
 	var wsURL = null,
+		// public key announced to the peers of an encrypted room.
+		peerKey = null,
 		pingInterval = 5, // seconds
 		reconnectInterval = 4000;
 
@@ -33,15 +63,27 @@ var Client = new function () {
 		triggers = {},
 		ping_timer = null,
 		reconnect_timer = null,
-		peer = { id: null, handle: null };
+		peer = { id: null, handle: null },
+		// sequence ID of the last payload received, to only get
+		// the missed ones on reconnection.
+		lastSeq = 0,
+		// delay in ms after which to reconnect, sent by the server
+		// when it's restarting.
+		restartDelay = null;
 
 
 	// Initialize and connect the websocket.
-	this.init = function (roomID) {
+	this.init = function (roomID, key) {
 		wsURL = document.location.protocol.replace(/http(s?):/, "ws$1:") +
 			document.location.host + "/r/" + roomID + "/ws";
+		peerKey = key || null;
 	};
 
+	// Sequence ID of the last payload received.
+	this.lastSeq = function () {
+		return lastSeq;
+	}
+
 	// Peer identification info.
 	this.peer = function () {
 		return peer;
@@ -49,7 +91,14 @@ var Client = new function () {
 
 	// websocket hooks
 	this.connect = function () {
-		ws = new WebSocket(wsURL);
+		var params = [];
+		if (lastSeq > 0) {
+			params.push("since=" + lastSeq);
+		}
+		if (peerKey) {
+			params.push("key=" + encodeURIComponent(peerKey));
+		}
+		ws = new WebSocket(params.length > 0 ? wsURL + "?" + params.join("&") : wsURL);
 		ws.onopen = function () {
 			trigger(MsgType["connect"]);
 		};
@@ -61,6 +110,12 @@ var Client = new function () {
 			} catch (e) {
 				return null;
 			}
+			if (data.seq > lastSeq) {
+				lastSeq = data.seq;
+			}
+			if (data.type == MsgType["server.restart"]) {
+				restartDelay = data.data.reconnect_in || reconnectInterval;
+			}
 			trigger(data.type, data);
 		};
 
@@ -70,6 +125,15 @@ var Client = new function () {
 		};
 
 		ws.onclose = function (e) {
+			// The server is restarting, come back after the delay it asked for.
+			if (restartDelay !== null) {
+				var delay = restartDelay;
+				restartDelay = null;
+				trigger(MsgType["disconnect"]);
+				attemptReconnection(delay);
+				return;
+			}
+
 			if (e.code == 1000) {
 				if (e.reason && MsgType.hasOwnProperty(e.reason)) {
 					trigger(e.reason);
@@ -128,12 +192,13 @@ var Client = new function () {
 		}
 	}
 
-	function attemptReconnection() {
-		trigger(MsgType["reconnecting"], reconnectInterval);
+	function attemptReconnection(delay) {
+		delay = delay || reconnectInterval;
+		trigger(MsgType["reconnecting"], delay);
 		reconnect_timer = setTimeout(function () {
 			reconnect_timer = null;
 			self.connect();
-		}, reconnectInterval);
+		}, delay);
 	}
 
 	var self = this;
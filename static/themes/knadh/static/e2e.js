@@ -0,0 +1,122 @@
+// End-to-end encryption of the messages of an encrypted room. The room key
+// is derived from a secret kept in the URL fragment, which browsers never
+// send to the server. Each peer also signs its messages with a key pair of
+// its own, whose public key it announces to the others on joining.
+var E2E = new function () {
+	const ivLen = 12,
+		keyInfo = "niltalk room key";
+
+	var roomKey = null,
+		signKey = null,
+		roomID = "";
+
+	// Public key of the peer, base64 encoded.
+	this.publicKey = "";
+
+	// Whether the browser can encrypt. Web Crypto is only available in
+	// secure contexts (https:// or localhost).
+	this.available = function () {
+		return !!(window.crypto && window.crypto.subtle);
+	};
+
+	// New random secret for a room, to put in the URL fragment.
+	this.newSecret = function () {
+		return encode(window.crypto.getRandomValues(new Uint8Array(32)))
+			.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	};
+
+	// Derive the room key from the secret and generate the peer's key pair.
+	this.init = function (secret, id) {
+		roomID = id;
+		const raw = decode(secret.replace(/-/g, "+").replace(/_/g, "/"));
+		const subtle = window.crypto.subtle;
+
+		return subtle.importKey("raw", raw, "HKDF", false, ["deriveKey"])
+			.then((k) => {
+				return subtle.deriveKey({
+					name: "HKDF",
+					hash: "SHA-256",
+					salt: new TextEncoder().encode(roomID),
+					info: new TextEncoder().encode(keyInfo)
+				}, k, { name: "AES-GCM", length: 256 }, false, ["encrypt", "decrypt"]);
+			})
+			.then((k) => {
+				roomKey = k;
+				return subtle.generateKey({ name: "ECDSA", namedCurve: "P-256" }, false, ["sign", "verify"]);
+			})
+			.then((pair) => {
+				signKey = pair.privateKey;
+				return subtle.exportKey("raw", pair.publicKey);
+			})
+			.then((pub) => {
+				this.publicKey = encode(new Uint8Array(pub));
+			});
+	};
+
+	// Encrypt and sign a message. Resolves to the base64 ciphertext.
+	this.encrypt = function (text) {
+		const subtle = window.crypto.subtle;
+		const iv = window.crypto.getRandomValues(new Uint8Array(ivLen));
+
+		return subtle.sign({ name: "ECDSA", hash: "SHA-256" }, signKey, signed(text))
+			.then((sig) => {
+				const plain = JSON.stringify({ m: text, s: encode(new Uint8Array(sig)) });
+				return subtle.encrypt({ name: "AES-GCM", iv: iv }, roomKey, new TextEncoder().encode(plain));
+			})
+			.then((c) => {
+				const out = new Uint8Array(ivLen + c.byteLength);
+				out.set(iv);
+				out.set(new Uint8Array(c), ivLen);
+				return encode(out);
+			});
+	};
+
+	// Decrypt a message and verify its signature against the public key
+	// announced by its sender, if it's known. Resolves to
+	// { text: "", verified: bool }.
+	this.decrypt = function (ciphertext, publicKey) {
+		const subtle = window.crypto.subtle;
+		const b = decode(ciphertext);
+		var text = "";
+
+		return subtle.decrypt({ name: "AES-GCM", iv: b.slice(0, ivLen) }, roomKey, b.slice(ivLen))
+			.then((plain) => {
+				const d = JSON.parse(new TextDecoder().decode(plain));
+				text = d.m;
+				if (!publicKey || !d.s) {
+					return false;
+				}
+				return subtle.importKey("raw", decode(publicKey), { name: "ECDSA", namedCurve: "P-256" }, false, ["verify"])
+					.then((k) => {
+						return subtle.verify({ name: "ECDSA", hash: "SHA-256" }, k, decode(d.s), signed(text));
+					})
+					.catch(() => false);
+			})
+			.then((ok) => {
+				return { text: text, verified: ok };
+			});
+	};
+
+	// ___ private
+	// the signed bytes of a message, bound to the room.
+	function signed(text) {
+		return new TextEncoder().encode(roomID + "\n" + text);
+	}
+
+	function encode(b) {
+		var s = "";
+		for (var i = 0; i < b.length; i++) {
+			s += String.fromCharCode(b[i]);
+		}
+		return btoa(s);
+	}
+
+	function decode(s) {
+		const bin = atob(s);
+		const b = new Uint8Array(bin.length);
+		for (var i = 0; i < bin.length; i++) {
+			b[i] = bin.charCodeAt(i);
+		}
+		return b;
+	}
+};
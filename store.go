@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"log"
 
 	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/bolt"
 	"github.com/knadh/niltalk/store/fs"
 	"github.com/knadh/niltalk/store/mem"
 	"github.com/knadh/niltalk/store/redis"
@@ -48,10 +50,35 @@ func (a *App) makeStore() (store.Store, error) {
 			log.Fatalf("error initializing store: %v", err)
 		}
 		store = s
-		defer s.Close()
+
+	} else if a.cfg.Storage == "bolt" {
+		var storeCfg bolt.Config
+		if err := ko.Unmarshal("store", &storeCfg); err != nil {
+			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+		}
+
+		s, err := bolt.New(storeCfg, logger)
+		if err != nil {
+			log.Fatalf("error initializing store: %v", err)
+		}
+		store = s
 
 	} else {
-		logger.Fatal("app.storage must be one of redis|memory|fs")
+		logger.Fatal("app.storage must be one of redis|memory|fs|bolt")
 	}
 	return store, nil
 }
+
+// makeBus creates a new store.Bus instance for cluster mode
+// according to configuration options.
+func (a *App) makeBus() (store.Bus, error) {
+	if a.cfg.Storage != "redis" {
+		return nil, errors.New("cluster mode requires app.storage = redis")
+	}
+
+	var storeCfg redis.Config
+	if err := ko.Unmarshal("store", &storeCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'store' config: %v", err)
+	}
+	return redis.NewBus(storeCfg, logger)
+}
@@ -0,0 +1,746 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Config represents the bolt store config structure.
+type Config struct {
+	Path    string        `koanf:"path"`
+	Timeout time.Duration `koanf:"timeout"`
+}
+
+// Bolt represents the embedded bbolt implementation of the Store interface.
+// Every write is a committed, fsynced transaction, and rooms, sessions
+// and history entries carry their own expiry.
+type Bolt struct {
+	cfg  *Config
+	db   *bolt.DB
+	log  *log.Logger
+	stop chan struct{}
+}
+
+var (
+	bucketRooms    = []byte("rooms")
+	bucketSessions = []byte("sessions")
+	bucketData     = []byte("data")
+	bucketHistory  = []byte("history")
+	bucketMail     = []byte("mail")
+	bucketTokens   = []byte("tokens")
+)
+
+type room struct {
+	store.Room
+	Expire time.Time `json:"expire"`
+	Seq    uint64    `json:"seq"`
+}
+
+type sess struct {
+	Handle string    `json:"handle"`
+	Role   string    `json:"role"`
+	Expire time.Time `json:"expire"`
+}
+
+type tokenEntry struct {
+	Handle string    `json:"handle"`
+	Expire time.Time `json:"expire"`
+}
+
+type histEntry struct {
+	Payload []byte    `json:"payload"`
+	Expire  time.Time `json:"expire"`
+}
+
+// expired tells if an expiry date is set and has passed.
+func expired(t time.Time, now time.Time) bool {
+	return !t.IsZero() && t.Before(now)
+}
+
+// New returns a new bolt store.
+func New(cfg Config, log *log.Logger) (*Bolt, error) {
+	if cfg.Path == "" {
+		cfg.Path = "niltalk.db"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second * 3
+	}
+
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: cfg.Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketRooms, bucketSessions, bucketData, bucketHistory, bucketMail, bucketTokens} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &Bolt{
+		cfg:  &cfg,
+		db:   db,
+		log:  log,
+		stop: make(chan struct{}),
+	}
+	go store.watch()
+	return store, nil
+}
+
+// watch the store to clean it up.
+func (b *Bolt) watch() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := b.cleanup(); err != nil {
+				b.log.Printf("error cleaning up bolt store %q: %v", b.cfg.Path, err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// cleanup the store to removes expired items.
+func (b *Bolt) cleanup() error {
+	now := time.Now()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var (
+			rooms    = tx.Bucket(bucketRooms)
+			sessions = tx.Bucket(bucketSessions)
+			expRooms [][]byte
+		)
+		// Buckets must not be modified while they are being iterated, collect
+		// the expired keys first.
+		err := rooms.ForEach(func(k, v []byte) error {
+			var r room
+			if err := json.Unmarshal(v, &r); err != nil || expired(r.Expire, now) {
+				expRooms = append(expRooms, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expRooms {
+			if err := rooms.Delete(k); err != nil {
+				return err
+			}
+			if sessions.Bucket(k) != nil {
+				if err := sessions.DeleteBucket(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := sweepNested(sessions, now, func(v []byte) time.Time {
+			var s sess
+			json.Unmarshal(v, &s)
+			return s.Expire
+		}); err != nil {
+			return err
+		}
+		histExpiry := func(v []byte) time.Time {
+			var e histEntry
+			json.Unmarshal(v, &e)
+			return e.Expire
+		}
+		if err := sweepNested(tx.Bucket(bucketHistory), now, histExpiry); err != nil {
+			return err
+		}
+		if err := sweepNested(tx.Bucket(bucketMail), now, histExpiry); err != nil {
+			return err
+		}
+		return sweepNested(tx.Bucket(bucketTokens), now, func(v []byte) time.Time {
+			var t tokenEntry
+			json.Unmarshal(v, &t)
+			return t.Expire
+		})
+	})
+}
+
+// sweepNested deletes the expired values in every sub-bucket of b. expiry
+// returns the expiry date decoded from a value.
+func sweepNested(b *bolt.Bucket, now time.Time, expiry func(v []byte) time.Time) error {
+	var ids [][]byte
+	b.ForEach(func(k, _ []byte) error {
+		ids = append(ids, k)
+		return nil
+	})
+	for _, id := range ids {
+		sub := b.Bucket(id)
+		if sub == nil {
+			continue
+		}
+		var exp [][]byte
+		sub.ForEach(func(k, v []byte) error {
+			if expired(expiry(v), now) {
+				exp = append(exp, k)
+			}
+			return nil
+		})
+		for _, k := range exp {
+			if err := sub.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close the underlying database.
+func (b *Bolt) Close() error {
+	close(b.stop)
+	return b.db.Close()
+}
+
+// getRoom reads a live room from the rooms bucket.
+func getRoom(tx *bolt.Tx, id string) (room, error) {
+	var r room
+	v := tx.Bucket(bucketRooms).Get([]byte(id))
+	if v == nil {
+		return r, store.ErrRoomNotFound
+	}
+	if err := json.Unmarshal(v, &r); err != nil {
+		return r, err
+	}
+	if expired(r.Expire, time.Now()) {
+		return r, store.ErrRoomNotFound
+	}
+	return r, nil
+}
+
+// putRoom writes a room to the rooms bucket.
+func putRoom(tx *bolt.Tx, r room) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketRooms).Put([]byte(r.ID), v)
+}
+
+// AddRoom adds a room to the store.
+func (b *Bolt) AddRoom(r store.Room, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putRoom(tx, room{Room: r, Expire: r.CreatedAt.Add(ttl)})
+	})
+}
+
+// AddPredefinedRoom adds a room to the store.
+func (b *Bolt) AddPredefinedRoom(r store.Room) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putRoom(tx, room{Room: r})
+	})
+}
+
+// UpdateRoom updates the properties of a room.
+func (b *Bolt) UpdateRoom(r store.Room) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		old, err := getRoom(tx, r.ID)
+		if err != nil {
+			return err
+		}
+		old.Room = r
+		return putRoom(tx, old)
+	})
+}
+
+// ExtendRoomTTL extends a room's TTL, and the TTL of its sessions.
+func (b *Bolt) ExtendRoomTTL(id string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		r, err := getRoom(tx, id)
+		if err != nil {
+			return err
+		}
+
+		exp := time.Now().Add(ttl)
+		if !r.Expire.IsZero() {
+			r.Expire = exp
+			if err := putRoom(tx, r); err != nil {
+				return err
+			}
+		}
+
+		rs := tx.Bucket(bucketSessions).Bucket([]byte(id))
+		if rs == nil {
+			return nil
+		}
+		extended := map[string][]byte{}
+		rs.ForEach(func(k, v []byte) error {
+			var s sess
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil
+			}
+			s.Expire = exp
+			extended[string(k)], _ = json.Marshal(s)
+			return nil
+		})
+		for k, v := range extended {
+			if err := rs.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRoom gets a room from the store.
+func (b *Bolt) GetRoom(id string) (store.Room, error) {
+	var out store.Room
+	err := b.db.View(func(tx *bolt.Tx) error {
+		r, err := getRoom(tx, id)
+		out = r.Room
+		return err
+	})
+	if err != nil {
+		return store.Room{}, err
+	}
+	return out, nil
+}
+
+// RoomExists checks if a room exists in the store.
+func (b *Bolt) RoomExists(id string) (bool, error) {
+	_, err := b.GetRoom(id)
+	if err == store.ErrRoomNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RemoveRoom deletes a room and its sessions, history, mail and tokens from
+// the store.
+func (b *Bolt) RemoveRoom(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketRooms).Delete([]byte(id)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketSessions, bucketHistory, bucketTokens} {
+			bk := tx.Bucket(name)
+			if bk.Bucket([]byte(id)) == nil {
+				continue
+			}
+			if err := bk.DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		// Mailboxes are keyed by room and handle. Buckets must not be
+		// modified while they are being iterated.
+		var (
+			mail   = tx.Bucket(bucketMail)
+			prefix = mailKey(id, "")
+			keys   [][]byte
+			c      = mail.Cursor()
+		)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := mail.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddSeq adds delta to the sequence counter of a room and returns it.
+func (b *Bolt) AddSeq(roomID string, delta uint64) (uint64, error) {
+	var seq uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		r, err := getRoom(tx, roomID)
+		if err != nil {
+			return err
+		}
+		r.Seq += delta
+		seq = r.Seq
+		return putRoom(tx, r)
+	})
+	return seq, err
+}
+
+// AddSession adds a sessionID room to the store.
+func (b *Bolt) AddSession(sessID, handle, role, roomID string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getRoom(tx, roomID); err != nil {
+			return err
+		}
+
+		rs, err := tx.Bucket(bucketSessions).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(sess{Handle: handle, Role: role, Expire: time.Now().Add(ttl)})
+		if err != nil {
+			return err
+		}
+		return rs.Put([]byte(sessID), v)
+	})
+}
+
+// GetSession retrieves a peer session from the store.
+func (b *Bolt) GetSession(sessID, roomID string) (store.Sess, error) {
+	var out store.Sess
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if _, err := getRoom(tx, roomID); err != nil {
+			return err
+		}
+
+		rs := tx.Bucket(bucketSessions).Bucket([]byte(roomID))
+		if rs == nil {
+			return nil
+		}
+		v := rs.Get([]byte(sessID))
+		if v == nil {
+			return nil
+		}
+		var s sess
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		if expired(s.Expire, time.Now()) {
+			return nil
+		}
+		out = store.Sess{
+			ID:     sessID,
+			Handle: s.Handle,
+			Role:   s.Role,
+		}
+		return nil
+	})
+	if err != nil {
+		return store.Sess{}, err
+	}
+	return out, nil
+}
+
+// RemoveSession deletes a session ID from a room.
+func (b *Bolt) RemoveSession(sessID, roomID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getRoom(tx, roomID); err != nil {
+			return err
+		}
+		rs := tx.Bucket(bucketSessions).Bucket([]byte(roomID))
+		if rs == nil {
+			return nil
+		}
+		return rs.Delete([]byte(sessID))
+	})
+}
+
+// ClearSessions deletes all the sessions in a room.
+func (b *Bolt) ClearSessions(roomID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getRoom(tx, roomID); err != nil {
+			return err
+		}
+		sessions := tx.Bucket(bucketSessions)
+		if sessions.Bucket([]byte(roomID)) == nil {
+			return nil
+		}
+		return sessions.DeleteBucket([]byte(roomID))
+	})
+}
+
+// Get value from a key.
+func (b *Bolt) Get(key string) ([]byte, error) {
+	var out []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketData).Get([]byte(key))
+		if v == nil {
+			return fmt.Errorf("key %q not found", key)
+		}
+		// Values are only valid for the lifetime of the transaction.
+		out = make([]byte, len(v))
+		copy(out, v)
+		return nil
+	})
+	return out, err
+}
+
+// Set a value.
+func (b *Bolt) Set(key string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketData).Put([]byte(key), data)
+	})
+}
+
+// Delete a value.
+func (b *Bolt) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketData).Delete([]byte(key))
+	})
+}
+
+// AddHistory appends a payload to a room's history, keeping at most max entries.
+func (b *Bolt) AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rh, err := tx.Bucket(bucketHistory).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		return appendEntry(rh, payload, max, ttl)
+	})
+}
+
+// appendEntry appends a payload to a bucket of history entries, keeping at
+// most max entries.
+func appendEntry(rh *bolt.Bucket, payload []byte, max int, ttl time.Duration) error {
+	e := histEntry{Payload: payload}
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Keys are big endian sequence numbers so that the cursor
+	// iterates in insertion order.
+	seq, err := rh.NextSequence()
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	if err := rh.Put(k, v); err != nil {
+		return err
+	}
+
+	if max <= 0 {
+		return nil
+	}
+	// Drop the oldest entries over the limit, those before the max-th one
+	// from the end.
+	c := rh.Cursor()
+	k, _ = c.Last()
+	for n := 1; n < max && k != nil; n++ {
+		k, _ = c.Prev()
+	}
+	if k == nil {
+		return nil
+	}
+	oldest := append([]byte(nil), k...)
+	for k, _ = c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetHistory returns the live history payloads of a room, oldest first.
+func (b *Bolt) GetHistory(roomID string) ([][]byte, error) {
+	var out [][]byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rh := tx.Bucket(bucketHistory).Bucket([]byte(roomID))
+		if rh == nil {
+			return nil
+		}
+		var err error
+		out, err = liveEntries(rh)
+		return err
+	})
+	return out, err
+}
+
+// liveEntries returns the payloads of the live entries of a bucket of history
+// entries, oldest first.
+func liveEntries(rh *bolt.Bucket) ([][]byte, error) {
+	var (
+		out [][]byte
+		now = time.Now()
+	)
+	err := rh.ForEach(func(_, v []byte) error {
+		var e histEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		if !expired(e.Expire, now) {
+			out = append(out, e.Payload)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// AddMail queues a payload for an offline user of a room, keeping at most max
+// payloads for the user.
+func (b *Bolt) AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		mb, err := tx.Bucket(bucketMail).CreateBucketIfNotExists(mailKey(roomID, handle))
+		if err != nil {
+			return err
+		}
+		return appendEntry(mb, payload, max, ttl)
+	})
+}
+
+// TakeMail returns the live payloads queued for a user of a room, oldest
+// first, and removes them.
+func (b *Bolt) TakeMail(roomID, handle string) ([][]byte, error) {
+	var out [][]byte
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		key := mailKey(roomID, handle)
+		mb := tx.Bucket(bucketMail).Bucket(key)
+		if mb == nil {
+			return nil
+		}
+		var err error
+		if out, err = liveEntries(mb); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMail).DeleteBucket(key)
+	})
+	return out, err
+}
+
+// AddToken stores an autologin token of a user of a room.
+func (b *Bolt) AddToken(roomID, token, handle string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rt, err := tx.Bucket(bucketTokens).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(tokenEntry{Handle: handle, Expire: time.Now().Add(ttl)})
+		if err != nil {
+			return err
+		}
+		return rt.Put([]byte(token), v)
+	})
+}
+
+// TakeToken returns the user of a live autologin token of a room and removes
+// the token.
+func (b *Bolt) TakeToken(roomID, token string) (string, error) {
+	var handle string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		rt := tx.Bucket(bucketTokens).Bucket([]byte(roomID))
+		if rt == nil {
+			return nil
+		}
+		v := rt.Get([]byte(token))
+		if v == nil {
+			return nil
+		}
+		var t tokenEntry
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		if !expired(t.Expire, time.Now()) {
+			handle = t.Handle
+		}
+		return rt.Delete([]byte(token))
+	})
+	return handle, err
+}
+
+// RevokeTokens removes the autologin tokens of a user of a room.
+func (b *Bolt) RevokeTokens(roomID, handle string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rt := tx.Bucket(bucketTokens).Bucket([]byte(roomID))
+		if rt == nil {
+			return nil
+		}
+		var revoked [][]byte
+		err := rt.ForEach(func(k, v []byte) error {
+			var t tokenEntry
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.Handle == handle {
+				revoked = append(revoked, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range revoked {
+			if err := rt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mailKey is the key of the mailbox of a user of a room.
+func mailKey(roomID, handle string) []byte {
+	return []byte(roomID + ":" + handle)
+}
+
+// ReplaceHistory replaces a payload of a room's history, keeping its expiry.
+func (b *Bolt) ReplaceHistory(roomID string, old, new []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rh := tx.Bucket(bucketHistory).Bucket([]byte(roomID))
+		if rh == nil {
+			return nil
+		}
+		c := rh.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e histEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !bytes.Equal(e.Payload, old) {
+				continue
+			}
+			e.Payload = new
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			return rh.Put(k, v)
+		}
+		return nil
+	})
+}
+
+// DeleteHistory removes a payload from a room's history.
+func (b *Bolt) DeleteHistory(roomID string, payload []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rh := tx.Bucket(bucketHistory).Bucket([]byte(roomID))
+		if rh == nil {
+			return nil
+		}
+		c := rh.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e histEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if bytes.Equal(e.Payload, payload) {
+				return c.Delete()
+			}
+		}
+		return nil
+	})
+}
+
+// ClearHistory deletes the history of a room.
+func (b *Bolt) ClearHistory(roomID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(bucketHistory)
+		if history.Bucket([]byte(roomID)) == nil {
+			return nil
+		}
+		return history.DeleteBucket([]byte(roomID))
+	})
+}
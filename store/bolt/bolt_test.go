@@ -0,0 +1,127 @@
+package bolt
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Bolt {
+	t.Helper()
+	b, err := New(Config{Path: filepath.Join(t.TempDir(), "niltalk.db")}, log.New(os.Stderr, "", 0))
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func payloads(from, to int) [][]byte {
+	var out [][]byte
+	for i := from; i <= to; i++ {
+		out = append(out, []byte(fmt.Sprintf("msg-%d", i)))
+	}
+	return out
+}
+
+func TestHistoryLimit(t *testing.T) {
+	b := newTestStore(t)
+	for _, p := range payloads(1, 10) {
+		if err := b.AddHistory("room", p, 3, time.Hour); err != nil {
+			t.Fatalf("error adding history: %v", err)
+		}
+	}
+
+	got, err := b.GetHistory("room")
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if want := payloads(8, 10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("history = %q, want %q", got, want)
+	}
+}
+
+func TestHistoryNoLimit(t *testing.T) {
+	b := newTestStore(t)
+	for _, p := range payloads(1, 5) {
+		if err := b.AddHistory("room", p, 0, 0); err != nil {
+			t.Fatalf("error adding history: %v", err)
+		}
+	}
+
+	got, err := b.GetHistory("room")
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if want := payloads(1, 5); !reflect.DeepEqual(got, want) {
+		t.Fatalf("history = %q, want %q", got, want)
+	}
+}
+
+func TestMailLimit(t *testing.T) {
+	b := newTestStore(t)
+	for _, p := range payloads(1, 4) {
+		if err := b.AddMail("room", "user", p, 2, time.Hour); err != nil {
+			t.Fatalf("error adding mail: %v", err)
+		}
+	}
+
+	got, err := b.TakeMail("room", "user")
+	if err != nil {
+		t.Fatalf("error taking mail: %v", err)
+	}
+	if want := payloads(3, 4); !reflect.DeepEqual(got, want) {
+		t.Fatalf("mail = %q, want %q", got, want)
+	}
+
+	got, err = b.TakeMail("room", "user")
+	if err != nil {
+		t.Fatalf("error taking mail: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("mail = %q after taking it, want none", got)
+	}
+}
+
+func TestRemoveRoom(t *testing.T) {
+	b := newTestStore(t)
+	for _, id := range []string{"room", "other"} {
+		if err := b.AddHistory(id, []byte("msg"), 0, time.Hour); err != nil {
+			t.Fatalf("error adding history: %v", err)
+		}
+		if err := b.AddMail(id, "user", []byte("msg"), 0, time.Hour); err != nil {
+			t.Fatalf("error adding mail: %v", err)
+		}
+		if err := b.AddToken(id, "token", "user", time.Hour); err != nil {
+			t.Fatalf("error adding token: %v", err)
+		}
+	}
+	if err := b.RemoveRoom("room"); err != nil {
+		t.Fatalf("error removing room: %v", err)
+	}
+
+	for id, want := range map[string]int{"room": 0, "other": 1} {
+		h, err := b.GetHistory(id)
+		if err != nil {
+			t.Fatalf("error reading history: %v", err)
+		}
+		m, err := b.TakeMail(id, "user")
+		if err != nil {
+			t.Fatalf("error taking mail: %v", err)
+		}
+		if len(h) != want || len(m) != want {
+			t.Errorf("%s: %d history and %d mail entries, want %d", id, len(h), len(m), want)
+		}
+		handle, err := b.TakeToken(id, "token")
+		if err != nil {
+			t.Fatalf("error taking token: %v", err)
+		}
+		if (handle != "") != (want > 0) {
+			t.Errorf("%s: token of %q", id, handle)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package store
+
+import "github.com/knadh/niltalk/internal/metrics"
+
+// MetricBusDropped counts the messages the buses drop for the subscribers
+// whose queue is full, rather than holding up the other subscribers.
+var MetricBusDropped = metrics.Default.NewCounter("niltalk_bus_messages_dropped_total",
+	"Bus messages dropped for subscribers that weren't keeping up.")
+
+// Bus represents a publish / subscribe message bus shared by several
+// niltalk instances.
+type Bus interface {
+	// Publish sends a message to every subscriber of a topic,
+	// including the ones of the publishing instance.
+	Publish(topic string, msg []byte) error
+
+	// Subscribe returns a channel that receives the messages published
+	// on a topic, and a function that ends the subscription. Messages
+	// arriving while the channel's buffer is full are dropped.
+	Subscribe(topic string) (<-chan []byte, func(), error)
+
+	Close() error
+}
@@ -1,11 +1,13 @@
 package fs
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,27 +21,45 @@ type Config struct {
 
 // File represents the file implementation of the Store interface.
 type File struct {
-	cfg   *Config
-	rooms map[string]*room
-	data  map[string][]byte
-	mu    sync.Mutex
-	dirty bool
-	log   *log.Logger
+	cfg     *Config
+	rooms   map[string]*room
+	data    map[string][]byte
+	history map[string][]histEntry
+	mail    map[string][]histEntry
+	tokens  map[string]tokenEntry
+	mu      sync.Mutex
+	dirty   bool
+	log     *log.Logger
 }
 
 type room struct {
 	store.Room
 	Sessions map[string]string
+	Roles    map[string]string
 	Expire   time.Time
+	Seq      uint64
+}
+
+type histEntry struct {
+	Payload []byte
+	Expire  time.Time
+}
+
+type tokenEntry struct {
+	Handle string
+	Expire time.Time
 }
 
 // New returns a new Redis store.
 func New(cfg Config, log *log.Logger) (*File, error) {
 	store := &File{
-		cfg:   &cfg,
-		rooms: map[string]*room{},
-		data:  map[string][]byte{},
-		log:   log,
+		cfg:     &cfg,
+		rooms:   map[string]*room{},
+		data:    map[string][]byte{},
+		history: map[string][]histEntry{},
+		mail:    map[string][]histEntry{},
+		tokens:  map[string]tokenEntry{},
+		log:     log,
 	}
 	err := store.load()
 	go store.watch()
@@ -70,14 +90,63 @@ func (m *File) cleanup() {
 			continue
 		}
 	}
+
+	for key, t := range m.tokens {
+		if t.Expire.Before(now) {
+			delete(m.tokens, key)
+			m.dirty = true
+		}
+	}
+
+	for id, h := range m.history {
+		n := len(h)
+		h = liveHistory(h, now)
+		if len(h) == n {
+			continue
+		}
+		if len(h) == 0 {
+			delete(m.history, id)
+		} else {
+			m.history[id] = h
+		}
+		m.dirty = true
+	}
+
+	for key, mb := range m.mail {
+		n := len(mb)
+		mb = liveHistory(mb, now)
+		if len(mb) == n {
+			continue
+		}
+		if len(mb) == 0 {
+			delete(m.mail, key)
+		} else {
+			m.mail[key] = mb
+		}
+		m.dirty = true
+	}
+}
+
+// liveHistory returns the history entries that have not expired.
+func liveHistory(h []histEntry, now time.Time) []histEntry {
+	out := h[:0]
+	for _, e := range h {
+		if e.Expire.IsZero() || e.Expire.After(now) {
+			out = append(out, e)
+		}
+	}
+	return out
 }
 
 // load the data from the file system.
 func (m *File) load() error {
 	if _, err := os.Stat(m.cfg.Path); err == nil {
 		x := struct {
-			Rooms map[string]*room
-			Data  map[string][]byte
+			Rooms   map[string]*room
+			Data    map[string][]byte
+			History map[string][]histEntry
+			Mail    map[string][]histEntry
+			Tokens  map[string]tokenEntry
 		}{}
 		var data []byte
 		data, err = ioutil.ReadFile(m.cfg.Path)
@@ -90,6 +159,15 @@ func (m *File) load() error {
 		}
 		m.rooms = x.Rooms
 		m.data = x.Data
+		if x.History != nil {
+			m.history = x.History
+		}
+		if x.Mail != nil {
+			m.mail = x.Mail
+		}
+		if x.Tokens != nil {
+			m.tokens = x.Tokens
+		}
 	}
 	return nil
 }
@@ -100,11 +178,17 @@ func (m *File) save() error {
 	defer m.mu.Unlock()
 	if m.dirty {
 		data, err := json.Marshal(struct {
-			Rooms map[string]*room
-			Data  map[string][]byte
+			Rooms   map[string]*room
+			Data    map[string][]byte
+			History map[string][]histEntry
+			Mail    map[string][]histEntry
+			Tokens  map[string]tokenEntry
 		}{
-			Rooms: m.rooms,
-			Data:  m.data,
+			Rooms:   m.rooms,
+			Data:    m.data,
+			History: m.history,
+			Mail:    m.mail,
+			Tokens:  m.tokens,
 		})
 		if err == nil {
 			m.dirty = false
@@ -133,6 +217,7 @@ func (m *File) AddRoom(r store.Room, ttl time.Duration) error {
 		Room:     r,
 		Expire:   r.CreatedAt.Add(ttl),
 		Sessions: map[string]string{},
+		Roles:    map[string]string{},
 	}
 	m.dirty = true
 
@@ -148,12 +233,27 @@ func (m *File) AddPredefinedRoom(r store.Room) error {
 	m.rooms[key] = &room{
 		Room:     r,
 		Sessions: map[string]string{},
+		Roles:    map[string]string{},
 	}
 	m.dirty = true
 
 	return nil
 }
 
+// UpdateRoom updates the properties of a room.
+func (m *File) UpdateRoom(r store.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[r.ID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Room = r
+	m.dirty = true
+	return nil
+}
+
 // ExtendRoomTTL extends a room's TTL.
 func (m *File) ExtendRoomTTL(id string, ttl time.Duration) error {
 	m.mu.Lock()
@@ -206,8 +306,22 @@ func (m *File) RemoveRoom(id string) error {
 	return nil
 }
 
+// AddSeq adds delta to the sequence counter of a room and returns it.
+func (m *File) AddSeq(roomID string, delta uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return 0, store.ErrRoomNotFound
+	}
+	room.Seq += delta
+	m.dirty = true
+	return room.Seq, nil
+}
+
 // AddSession adds a sessionID room to the store.
-func (m *File) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (m *File) AddSession(sessID, handle, role, roomID string, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -218,6 +332,11 @@ func (m *File) AddSession(sessID, handle, roomID string, ttl time.Duration) erro
 	}
 
 	room.Sessions[sessID] = handle
+	// Rooms saved by older versions have no roles.
+	if room.Roles == nil {
+		room.Roles = map[string]string{}
+	}
+	room.Roles[sessID] = role
 	m.rooms[roomID] = room
 	m.dirty = true
 
@@ -244,6 +363,7 @@ func (m *File) GetSession(sessID, roomID string) (store.Sess, error) {
 	return store.Sess{
 		ID:     sessID,
 		Handle: handle,
+		Role:   room.Roles[sessID],
 	}, nil
 }
 
@@ -260,6 +380,7 @@ func (m *File) RemoveSession(sessID, roomID string) error {
 
 	if _, ok := room.Sessions[sessID]; ok {
 		delete(room.Sessions, sessID)
+		delete(room.Roles, sessID)
 		m.rooms[roomID] = room
 		m.dirty = true
 	}
@@ -279,6 +400,7 @@ func (m *File) ClearSessions(roomID string) error {
 	}
 
 	room.Sessions = map[string]string{}
+	room.Roles = map[string]string{}
 
 	m.rooms[roomID] = room
 	m.dirty = true
@@ -315,3 +437,175 @@ func (m *File) Delete(key string) error {
 	m.dirty = true
 	return nil
 }
+
+// AddHistory appends a payload to a room's history, keeping at most max entries.
+func (m *File) AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := histEntry{Payload: make([]byte, len(payload))}
+	copy(e.Payload, payload)
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+
+	h := append(m.history[roomID], e)
+	if max > 0 && len(h) > max {
+		h = h[len(h)-max:]
+	}
+	m.history[roomID] = h
+	m.dirty = true
+	return nil
+}
+
+// GetHistory returns the live history payloads of a room, oldest first.
+func (m *File) GetHistory(roomID string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	out := make([][]byte, 0, len(m.history[roomID]))
+	for _, e := range m.history[roomID] {
+		if e.Expire.IsZero() || e.Expire.After(now) {
+			out = append(out, e.Payload)
+		}
+	}
+	return out, nil
+}
+
+// ReplaceHistory replaces a payload of a room's history, keeping its expiry.
+func (m *File) ReplaceHistory(roomID string, old, new []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.history[roomID] {
+		if bytes.Equal(e.Payload, old) {
+			m.history[roomID][i].Payload = append([]byte(nil), new...)
+			m.dirty = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// DeleteHistory removes a payload from a room's history.
+func (m *File) DeleteHistory(roomID string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.history[roomID]
+	for i, e := range h {
+		if bytes.Equal(e.Payload, payload) {
+			m.history[roomID] = append(h[:i], h[i+1:]...)
+			m.dirty = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// AddMail queues a payload for an offline user of a room, keeping at most max
+// payloads for the user.
+func (m *File) AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := histEntry{Payload: make([]byte, len(payload))}
+	copy(e.Payload, payload)
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+
+	key := mailKey(roomID, handle)
+	mb := append(m.mail[key], e)
+	if max > 0 && len(mb) > max {
+		mb = mb[len(mb)-max:]
+	}
+	m.mail[key] = mb
+	m.dirty = true
+	return nil
+}
+
+// TakeMail returns the live payloads queued for a user of a room, oldest
+// first, and removes them.
+func (m *File) TakeMail(roomID, handle string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := mailKey(roomID, handle)
+	mb := liveHistory(m.mail[key], time.Now())
+	if _, ok := m.mail[key]; ok {
+		delete(m.mail, key)
+		m.dirty = true
+	}
+
+	out := make([][]byte, 0, len(mb))
+	for _, e := range mb {
+		out = append(out, e.Payload)
+	}
+	return out, nil
+}
+
+// AddToken stores an autologin token of a user of a room.
+func (m *File) AddToken(roomID, token, handle string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[tokenKey(roomID, token)] = tokenEntry{Handle: handle, Expire: time.Now().Add(ttl)}
+	m.dirty = true
+	return nil
+}
+
+// TakeToken returns the user of a live autologin token of a room and removes
+// the token.
+func (m *File) TakeToken(roomID, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := tokenKey(roomID, token)
+	t, ok := m.tokens[key]
+	if !ok {
+		return "", nil
+	}
+	delete(m.tokens, key)
+	m.dirty = true
+	if t.Expire.Before(time.Now()) {
+		return "", nil
+	}
+	return t.Handle, nil
+}
+
+// RevokeTokens removes the autologin tokens of a user of a room.
+func (m *File) RevokeTokens(roomID, handle string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.Handle == handle && strings.HasPrefix(key, roomID+":") {
+			delete(m.tokens, key)
+			m.dirty = true
+		}
+	}
+	return nil
+}
+
+// tokenKey is the key of an autologin token of a room.
+func tokenKey(roomID, token string) string {
+	return roomID + ":" + token
+}
+
+// mailKey is the key of the mailbox of a user of a room.
+func mailKey(roomID, handle string) string {
+	return roomID + ":" + handle
+}
+
+// ClearHistory deletes the history of a room.
+func (m *File) ClearHistory(roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.history[roomID]; ok {
+		delete(m.history, roomID)
+		m.dirty = true
+	}
+	return nil
+}
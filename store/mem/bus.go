@@ -0,0 +1,83 @@
+package mem
+
+import (
+	"sync"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Bus represents the in-process implementation of the Bus interface.
+// Every instance sharing a Bus value sees the messages of the others.
+type Bus struct {
+	subs map[string]map[*sub]bool
+	mu   sync.Mutex
+}
+
+type sub struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+// NewBus returns a new in-process bus.
+func NewBus() *Bus {
+	return &Bus{
+		subs: map[string]map[*sub]bool{},
+	}
+}
+
+// Publish sends a message to every subscriber of a topic. The message is
+// dropped for the subscribers whose queue is full, as a room publishing to
+// its own full queue would never get to drain it.
+func (b *Bus) Publish(topic string, msg []byte) error {
+	b.mu.Lock()
+	subs := make([]*sub, 0, len(b.subs[topic]))
+	for s := range b.subs[topic] {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		m := make([]byte, len(msg))
+		copy(m, msg)
+		select {
+		case s.ch <- m:
+		case <-s.done:
+		default:
+			store.MetricBusDropped.Inc()
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a channel receiving the messages published on a topic.
+func (b *Bus) Subscribe(topic string) (<-chan []byte, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &sub{
+		ch:   make(chan []byte, 100),
+		done: make(chan struct{}),
+	}
+	if _, ok := b.subs[topic]; !ok {
+		b.subs[topic] = map[*sub]bool{}
+	}
+	b.subs[topic][s] = true
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[topic], s)
+			if len(b.subs[topic]) == 0 {
+				delete(b.subs, topic)
+			}
+			b.mu.Unlock()
+			close(s.done)
+		})
+	}, nil
+}
+
+// Close the bus.
+func (b *Bus) Close() error {
+	return nil
+}
@@ -1,7 +1,9 @@
 package mem
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,24 +15,42 @@ type Config struct{}
 
 // InMemory represents the in-memory implementation of the Store interface.
 type InMemory struct {
-	cfg   *Config
-	rooms map[string]*room
-	data  map[string][]byte
-	mu    sync.Mutex
+	cfg     *Config
+	rooms   map[string]*room
+	data    map[string][]byte
+	history map[string][]histEntry
+	mail    map[string][]histEntry
+	tokens  map[string]tokenEntry
+	mu      sync.Mutex
 }
 
 type room struct {
 	store.Room
 	Sessions map[string]string
+	Roles    map[string]string
 	Expire   time.Time
+	Seq      uint64
+}
+
+type histEntry struct {
+	Payload []byte
+	Expire  time.Time
+}
+
+type tokenEntry struct {
+	Handle string
+	Expire time.Time
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*InMemory, error) {
 	store := &InMemory{
-		cfg:   &cfg,
-		rooms: map[string]*room{},
-		data:  map[string][]byte{},
+		cfg:     &cfg,
+		rooms:   map[string]*room{},
+		data:    map[string][]byte{},
+		history: map[string][]histEntry{},
+		mail:    map[string][]histEntry{},
+		tokens:  map[string]tokenEntry{},
 	}
 	go store.watch()
 	return store, nil
@@ -58,6 +78,41 @@ func (m *InMemory) cleanup() {
 			continue
 		}
 	}
+
+	for key, t := range m.tokens {
+		if t.Expire.Before(now) {
+			delete(m.tokens, key)
+		}
+	}
+
+	for id, h := range m.history {
+		h = liveHistory(h, now)
+		if len(h) == 0 {
+			delete(m.history, id)
+			continue
+		}
+		m.history[id] = h
+	}
+
+	for key, mb := range m.mail {
+		mb = liveHistory(mb, now)
+		if len(mb) == 0 {
+			delete(m.mail, key)
+			continue
+		}
+		m.mail[key] = mb
+	}
+}
+
+// liveHistory returns the history entries that have not expired.
+func liveHistory(h []histEntry, now time.Time) []histEntry {
+	out := h[:0]
+	for _, e := range h {
+		if e.Expire.IsZero() || e.Expire.After(now) {
+			out = append(out, e)
+		}
+	}
+	return out
 }
 
 // AddRoom adds a room to the store.
@@ -69,6 +124,7 @@ func (m *InMemory) AddRoom(r store.Room, ttl time.Duration) error {
 		Room:     r,
 		Expire:   r.CreatedAt.Add(ttl),
 		Sessions: map[string]string{},
+		Roles:    map[string]string{},
 	}
 
 	return nil
@@ -83,11 +139,25 @@ func (m *InMemory) AddPredefinedRoom(r store.Room) error {
 	m.rooms[key] = &room{
 		Room:     r,
 		Sessions: map[string]string{},
+		Roles:    map[string]string{},
 	}
 
 	return nil
 }
 
+// UpdateRoom updates the properties of a room.
+func (m *InMemory) UpdateRoom(r store.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[r.ID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Room = r
+	return nil
+}
+
 // ExtendRoomTTL extends a room's TTL.
 func (m *InMemory) ExtendRoomTTL(id string, ttl time.Duration) error {
 	m.mu.Lock()
@@ -136,8 +206,21 @@ func (m *InMemory) RemoveRoom(id string) error {
 	return nil
 }
 
+// AddSeq adds delta to the sequence counter of a room and returns it.
+func (m *InMemory) AddSeq(roomID string, delta uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return 0, store.ErrRoomNotFound
+	}
+	room.Seq += delta
+	return room.Seq, nil
+}
+
 // AddSession adds a sessionID room to the store.
-func (m *InMemory) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (m *InMemory) AddSession(sessID, handle, role, roomID string, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -148,6 +231,7 @@ func (m *InMemory) AddSession(sessID, handle, roomID string, ttl time.Duration)
 	}
 
 	room.Sessions[sessID] = handle
+	room.Roles[sessID] = role
 	m.rooms[roomID] = room
 
 	return nil
@@ -173,6 +257,7 @@ func (m *InMemory) GetSession(sessID, roomID string) (store.Sess, error) {
 	return store.Sess{
 		ID:     sessID,
 		Handle: handle,
+		Role:   room.Roles[sessID],
 	}, nil
 }
 
@@ -188,6 +273,7 @@ func (m *InMemory) RemoveSession(sessID, roomID string) error {
 	}
 
 	delete(room.Sessions, sessID)
+	delete(room.Roles, sessID)
 	m.rooms[roomID] = room
 
 	return nil
@@ -205,6 +291,7 @@ func (m *InMemory) ClearSessions(roomID string) error {
 	}
 
 	room.Sessions = map[string]string{}
+	room.Roles = map[string]string{}
 
 	m.rooms[roomID] = room
 
@@ -238,3 +325,167 @@ func (m *InMemory) Delete(key string) error {
 	delete(m.data, key)
 	return nil
 }
+
+// AddHistory appends a payload to a room's history, keeping at most max entries.
+func (m *InMemory) AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := histEntry{Payload: make([]byte, len(payload))}
+	copy(e.Payload, payload)
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+
+	h := append(m.history[roomID], e)
+	if max > 0 && len(h) > max {
+		h = h[len(h)-max:]
+	}
+	m.history[roomID] = h
+	return nil
+}
+
+// GetHistory returns the live history payloads of a room, oldest first.
+func (m *InMemory) GetHistory(roomID string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := liveHistory(m.history[roomID], time.Now())
+	m.history[roomID] = h
+
+	out := make([][]byte, 0, len(h))
+	for _, e := range h {
+		out = append(out, e.Payload)
+	}
+	return out, nil
+}
+
+// AddMail queues a payload for an offline user of a room, keeping at most max
+// payloads for the user.
+func (m *InMemory) AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := histEntry{Payload: make([]byte, len(payload))}
+	copy(e.Payload, payload)
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+
+	key := mailKey(roomID, handle)
+	mb := append(m.mail[key], e)
+	if max > 0 && len(mb) > max {
+		mb = mb[len(mb)-max:]
+	}
+	m.mail[key] = mb
+	return nil
+}
+
+// TakeMail returns the live payloads queued for a user of a room, oldest
+// first, and removes them.
+func (m *InMemory) TakeMail(roomID, handle string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := mailKey(roomID, handle)
+	mb := liveHistory(m.mail[key], time.Now())
+	delete(m.mail, key)
+
+	out := make([][]byte, 0, len(mb))
+	for _, e := range mb {
+		out = append(out, e.Payload)
+	}
+	return out, nil
+}
+
+// AddToken stores an autologin token of a user of a room.
+func (m *InMemory) AddToken(roomID, token, handle string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[tokenKey(roomID, token)] = tokenEntry{Handle: handle, Expire: time.Now().Add(ttl)}
+	return nil
+}
+
+// TakeToken returns the user of a live autologin token of a room and removes
+// the token.
+func (m *InMemory) TakeToken(roomID, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := tokenKey(roomID, token)
+	t, ok := m.tokens[key]
+	if !ok {
+		return "", nil
+	}
+	delete(m.tokens, key)
+	if t.Expire.Before(time.Now()) {
+		return "", nil
+	}
+	return t.Handle, nil
+}
+
+// RevokeTokens removes the autologin tokens of a user of a room.
+func (m *InMemory) RevokeTokens(roomID, handle string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.Handle == handle && strings.HasPrefix(key, roomID+":") {
+			delete(m.tokens, key)
+		}
+	}
+	return nil
+}
+
+// tokenKey is the key of an autologin token of a room.
+func tokenKey(roomID, token string) string {
+	return roomID + ":" + token
+}
+
+// mailKey is the key of the mailbox of a user of a room.
+func mailKey(roomID, handle string) string {
+	return roomID + ":" + handle
+}
+
+// ClearHistory deletes the history of a room.
+func (m *InMemory) ClearHistory(roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.history, roomID)
+	return nil
+}
+
+// ReplaceHistory replaces a payload of a room's history, keeping its expiry.
+func (m *InMemory) ReplaceHistory(roomID string, old, new []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.history[roomID] {
+		if bytes.Equal(e.Payload, old) {
+			m.history[roomID][i].Payload = append([]byte(nil), new...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// DeleteHistory removes a payload from a room's history.
+func (m *InMemory) DeleteHistory(roomID string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.history[roomID]
+	for i, e := range h {
+		if bytes.Equal(e.Payload, payload) {
+			m.history[roomID] = append(h[:i], h[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Close the store, there's nothing to flush.
+func (m *InMemory) Close() error {
+	return nil
+}
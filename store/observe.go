@@ -0,0 +1,199 @@
+package store
+
+import "time"
+
+// ObserveFunc is called after every store operation with its name, duration
+// and error.
+type ObserveFunc func(op string, d time.Duration, err error)
+
+// Observe wraps a store to report its operations to the given function.
+func Observe(s Store, fn ObserveFunc) Store {
+	return &observed{s: s, fn: fn}
+}
+
+type observed struct {
+	s  Store
+	fn ObserveFunc
+}
+
+func (o *observed) AddPredefinedRoom(room Room) error {
+	start := time.Now()
+	err := o.s.AddPredefinedRoom(room)
+	o.fn("add_predefined_room", time.Since(start), err)
+	return err
+}
+
+func (o *observed) AddRoom(r Room, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.AddRoom(r, ttl)
+	o.fn("add_room", time.Since(start), err)
+	return err
+}
+
+func (o *observed) GetRoom(id string) (Room, error) {
+	start := time.Now()
+	r, err := o.s.GetRoom(id)
+	o.fn("get_room", time.Since(start), err)
+	return r, err
+}
+
+func (o *observed) UpdateRoom(r Room) error {
+	start := time.Now()
+	err := o.s.UpdateRoom(r)
+	o.fn("update_room", time.Since(start), err)
+	return err
+}
+
+func (o *observed) ExtendRoomTTL(id string, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.ExtendRoomTTL(id, ttl)
+	o.fn("extend_room_ttl", time.Since(start), err)
+	return err
+}
+
+func (o *observed) RoomExists(id string) (bool, error) {
+	start := time.Now()
+	ok, err := o.s.RoomExists(id)
+	o.fn("room_exists", time.Since(start), err)
+	return ok, err
+}
+
+func (o *observed) RemoveRoom(id string) error {
+	start := time.Now()
+	err := o.s.RemoveRoom(id)
+	o.fn("remove_room", time.Since(start), err)
+	return err
+}
+
+func (o *observed) AddSeq(roomID string, delta uint64) (uint64, error) {
+	start := time.Now()
+	seq, err := o.s.AddSeq(roomID, delta)
+	o.fn("add_seq", time.Since(start), err)
+	return seq, err
+}
+
+func (o *observed) AddSession(sessID, handle, role, roomID string, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.AddSession(sessID, handle, role, roomID, ttl)
+	o.fn("add_session", time.Since(start), err)
+	return err
+}
+
+func (o *observed) GetSession(sessID, roomID string) (Sess, error) {
+	start := time.Now()
+	s, err := o.s.GetSession(sessID, roomID)
+	o.fn("get_session", time.Since(start), err)
+	return s, err
+}
+
+func (o *observed) RemoveSession(sessID, roomID string) error {
+	start := time.Now()
+	err := o.s.RemoveSession(sessID, roomID)
+	o.fn("remove_session", time.Since(start), err)
+	return err
+}
+
+func (o *observed) ClearSessions(roomID string) error {
+	start := time.Now()
+	err := o.s.ClearSessions(roomID)
+	o.fn("clear_sessions", time.Since(start), err)
+	return err
+}
+
+func (o *observed) AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.AddHistory(roomID, payload, max, ttl)
+	o.fn("add_history", time.Since(start), err)
+	return err
+}
+
+func (o *observed) GetHistory(roomID string) ([][]byte, error) {
+	start := time.Now()
+	h, err := o.s.GetHistory(roomID)
+	o.fn("get_history", time.Since(start), err)
+	return h, err
+}
+
+func (o *observed) ClearHistory(roomID string) error {
+	start := time.Now()
+	err := o.s.ClearHistory(roomID)
+	o.fn("clear_history", time.Since(start), err)
+	return err
+}
+
+func (o *observed) ReplaceHistory(roomID string, old, new []byte) error {
+	start := time.Now()
+	err := o.s.ReplaceHistory(roomID, old, new)
+	o.fn("replace_history", time.Since(start), err)
+	return err
+}
+
+func (o *observed) DeleteHistory(roomID string, payload []byte) error {
+	start := time.Now()
+	err := o.s.DeleteHistory(roomID, payload)
+	o.fn("delete_history", time.Since(start), err)
+	return err
+}
+
+func (o *observed) AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.AddMail(roomID, handle, payload, max, ttl)
+	o.fn("add_mail", time.Since(start), err)
+	return err
+}
+
+func (o *observed) TakeMail(roomID, handle string) ([][]byte, error) {
+	start := time.Now()
+	m, err := o.s.TakeMail(roomID, handle)
+	o.fn("take_mail", time.Since(start), err)
+	return m, err
+}
+
+func (o *observed) AddToken(roomID, token, handle string, ttl time.Duration) error {
+	start := time.Now()
+	err := o.s.AddToken(roomID, token, handle, ttl)
+	o.fn("add_token", time.Since(start), err)
+	return err
+}
+
+func (o *observed) TakeToken(roomID, token string) (string, error) {
+	start := time.Now()
+	h, err := o.s.TakeToken(roomID, token)
+	o.fn("take_token", time.Since(start), err)
+	return h, err
+}
+
+func (o *observed) RevokeTokens(roomID, handle string) error {
+	start := time.Now()
+	err := o.s.RevokeTokens(roomID, handle)
+	o.fn("revoke_tokens", time.Since(start), err)
+	return err
+}
+
+func (o *observed) Get(key string) ([]byte, error) {
+	start := time.Now()
+	b, err := o.s.Get(key)
+	o.fn("get", time.Since(start), err)
+	return b, err
+}
+
+func (o *observed) Set(key string, value []byte) error {
+	start := time.Now()
+	err := o.s.Set(key, value)
+	o.fn("set", time.Since(start), err)
+	return err
+}
+
+func (o *observed) Delete(key string) error {
+	start := time.Now()
+	err := o.s.Delete(key)
+	o.fn("delete", time.Since(start), err)
+	return err
+}
+
+func (o *observed) Close() error {
+	start := time.Now()
+	err := o.s.Close()
+	o.fn("close", time.Since(start), err)
+	return err
+}
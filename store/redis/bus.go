@@ -0,0 +1,166 @@
+package redis
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/knadh/niltalk/store"
+)
+
+// Bus represents the Redis pub/sub implementation of the Bus interface.
+// All the topics are multiplexed over a single subscriber connection.
+type Bus struct {
+	cfg  *Config
+	pool *redis.Pool
+	psc  redis.PubSubConn
+	log  *log.Logger
+
+	// Subscribers by Redis channel.
+	subs map[string]map[*sub]bool
+	mu   sync.Mutex
+
+	closed chan struct{}
+}
+
+type sub struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+// NewBus returns a new Redis bus.
+func NewBus(cfg Config, l *log.Logger) (*Bus, error) {
+	if cfg.PrefixChannel == "" {
+		cfg.PrefixChannel = "NIL:BUS:ROOM:%s"
+	}
+
+	pool := newPool(cfg)
+	c := pool.Get()
+	if err := c.Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	b := &Bus{
+		cfg:    &cfg,
+		pool:   pool,
+		psc:    redis.PubSubConn{Conn: c},
+		log:    l,
+		subs:   map[string]map[*sub]bool{},
+		closed: make(chan struct{}),
+	}
+	go b.receive()
+	return b, nil
+}
+
+// receive dispatches the incoming messages to the subscribers. It reconnects
+// and subscribes again to every channel when the connection drops.
+func (b *Bus) receive() {
+	for {
+		switch v := b.psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			b.dispatch(v.Channel, v.Data)
+
+		case error:
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			b.log.Printf("error receiving from redis bus: %v", v)
+			time.Sleep(time.Second)
+			b.reconnect()
+		}
+	}
+}
+
+// reconnect replaces the subscriber connection.
+func (b *Bus) reconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.psc.Close()
+	b.psc = redis.PubSubConn{Conn: b.pool.Get()}
+
+	for ch := range b.subs {
+		if err := b.psc.Subscribe(ch); err != nil {
+			b.log.Printf("error subscribing to redis channel %q: %v", ch, err)
+		}
+	}
+}
+
+// dispatch sends a message to the subscribers of a channel. It doesn't wait
+// for the subscribers whose queue is full, which would hold up every channel,
+// and drops the message for them instead.
+func (b *Bus) dispatch(channel string, msg []byte) {
+	b.mu.Lock()
+	subs := make([]*sub, 0, len(b.subs[channel]))
+	for s := range b.subs[channel] {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+		default:
+			store.MetricBusDropped.Inc()
+			b.log.Printf("dropped message on redis channel %q: subscriber queue full", channel)
+		}
+	}
+}
+
+// Publish sends a message to every subscriber of a topic.
+func (b *Bus) Publish(topic string, msg []byte) error {
+	c := b.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("PUBLISH", fmt.Sprintf(b.cfg.PrefixChannel, topic), msg)
+	return err
+}
+
+// Subscribe returns a channel receiving the messages published on a topic.
+func (b *Bus) Subscribe(topic string) (<-chan []byte, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	channel := fmt.Sprintf(b.cfg.PrefixChannel, topic)
+	if _, ok := b.subs[channel]; !ok {
+		if err := b.psc.Subscribe(channel); err != nil {
+			return nil, nil, err
+		}
+		b.subs[channel] = map[*sub]bool{}
+	}
+
+	s := &sub{
+		ch:   make(chan []byte, 100),
+		done: make(chan struct{}),
+	}
+	b.subs[channel][s] = true
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[channel], s)
+			if len(b.subs[channel]) == 0 {
+				delete(b.subs, channel)
+				b.psc.Unsubscribe(channel)
+			}
+			b.mu.Unlock()
+			close(s.done)
+		})
+	}, nil
+}
+
+// Close the subscriber connection and the pool.
+func (b *Bus) Close() error {
+	close(b.closed)
+	b.mu.Lock()
+	b.psc.Close()
+	b.mu.Unlock()
+	return b.pool.Close()
+}
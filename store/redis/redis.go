@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -19,6 +21,10 @@ type Config struct {
 
 	PrefixRoom    string `koanf:"prefix_room"`
 	PrefixSession string `koanf:"prefix_session"`
+	PrefixHistory string `koanf:"prefix_history"`
+	PrefixMail    string `koanf:"prefix_mail"`
+	PrefixToken   string `koanf:"prefix_token"`
+	PrefixChannel string `koanf:"prefix_channel"`
 }
 
 // Redis represents the Redis implementation of the Store interface.
@@ -31,12 +37,40 @@ type room struct {
 	ID        string `redis:"id"`
 	Name      string `redis:"name"`
 	Password  []byte `redis:"password"`
+	OwnerKey  []byte `redis:"owner_key"`
 	CreatedAt string `redis:"created_at"`
+	Encrypted bool   `redis:"encrypted"`
+	Topic     string `redis:"topic"`
+	Pins      []byte `redis:"pins"`
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*Redis, error) {
-	pool := &redis.Pool{
+	if cfg.PrefixHistory == "" {
+		cfg.PrefixHistory = "NIL:HIST:ROOM:%s"
+	}
+	if cfg.PrefixMail == "" {
+		cfg.PrefixMail = "NIL:MAIL:ROOM:%s:%s"
+	}
+	if cfg.PrefixToken == "" {
+		cfg.PrefixToken = "NIL:TOKEN:ROOM:%s:%s"
+	}
+
+	pool := newPool(cfg)
+
+	// Test connection.
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	return &Redis{cfg: &cfg, pool: pool}, nil
+}
+
+// newPool returns a connection pool for the given configuration.
+func newPool(cfg Config) *redis.Pool {
+	return &redis.Pool{
 		Wait:      true,
 		MaxActive: cfg.ActiveConns,
 		MaxIdle:   cfg.IdleConns,
@@ -52,15 +86,6 @@ func New(cfg Config) (*Redis, error) {
 			)
 		},
 	}
-
-	// Test connection.
-	c := pool.Get()
-	defer c.Close()
-
-	if err := c.Err(); err != nil {
-		return nil, err
-	}
-	return &Redis{cfg: &cfg, pool: pool}, nil
 }
 
 // AddRoom adds a room to the store.
@@ -69,10 +94,11 @@ func (r *Redis) AddRoom(room store.Room, ttl time.Duration) error {
 	defer c.Close()
 
 	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
-	c.Send("HMSET", key,
-		"name", room.Name,
-		"created_at", room.CreatedAt.Format(time.RFC3339),
-		"password", room.Password)
+	args, err := roomArgs(key, room)
+	if err != nil {
+		return err
+	}
+	c.Send("HMSET", args...)
 	c.Send("EXPIRE", key, int(ttl.Seconds()))
 	return c.Flush()
 }
@@ -82,12 +108,49 @@ func (r *Redis) AddPredefinedRoom(room store.Room) error {
 	c := r.pool.Get()
 	defer c.Close()
 
+	args, err := roomArgs(fmt.Sprintf(r.cfg.PrefixRoom, room.ID), room)
+	if err != nil {
+		return err
+	}
+	c.Send("HMSET", args...)
+	return c.Flush()
+}
+
+// UpdateRoom updates the properties of a room.
+func (r *Redis) UpdateRoom(room store.Room) error {
+	c := r.pool.Get()
+	defer c.Close()
+
 	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
-	c.Send("HMSET", key,
+	ok, err := redis.Bool(c.Do("EXISTS", key))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	args, err := roomArgs(key, room)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HMSET", args...)
+	return err
+}
+
+// roomArgs returns the HMSET arguments of a room's hash.
+func roomArgs(key string, room store.Room) ([]interface{}, error) {
+	pins, err := json.Marshal(room.Pins)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{key,
 		"name", room.Name,
 		"created_at", room.CreatedAt.Format(time.RFC3339),
-		"password", room.Password)
-	return c.Flush()
+		"password", room.Password,
+		"owner_key", room.OwnerKey,
+		"encrypted", room.Encrypted,
+		"topic", room.Topic,
+		"pins", pins}, nil
 }
 
 // ExtendRoomTTL extends a room's TTL.
@@ -97,6 +160,8 @@ func (r *Redis) ExtendRoomTTL(id string, ttl time.Duration) error {
 
 	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixRoom, id), int(ttl.Seconds()))
 	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixSession, id), int(ttl.Seconds()))
+	c.Send("EXPIRE", r.rolesKey(id), int(ttl.Seconds()))
+	c.Send("EXPIRE", r.seqKey(id), int(ttl.Seconds()))
 	return c.Flush()
 }
 
@@ -125,12 +190,21 @@ func (r *Redis) GetRoom(id string) (store.Room, error) {
 	if t.Year() == 1 {
 		return out, store.ErrRoomNotFound
 	}
-	return store.Room{
+	out = store.Room{
 		ID:        id,
 		Name:      room.Name,
 		Password:  room.Password,
+		OwnerKey:  room.OwnerKey,
 		CreatedAt: t,
-	}, nil
+		Encrypted: room.Encrypted,
+		Topic:     room.Topic,
+	}
+	if len(room.Pins) > 0 {
+		if err := json.Unmarshal(room.Pins, &out.Pins); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
 }
 
 // RoomExists checks if a room exists in the store.
@@ -150,18 +224,54 @@ func (r *Redis) RemoveRoom(id string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id)))
+	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id), r.seqKey(id)))
 	return err
 }
 
+// seqKey returns the key of the sequence counter of a room.
+func (r *Redis) seqKey(roomID string) string {
+	return fmt.Sprintf(r.cfg.PrefixRoom, roomID) + ":SEQ"
+}
+
+// AddSeq adds delta to the sequence counter of a room and returns it.
+func (r *Redis) AddSeq(roomID string, delta uint64) (uint64, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := r.seqKey(roomID)
+	seq, err := redis.Uint64(c.Do("INCRBY", key, delta))
+	if err != nil {
+		return 0, err
+	}
+
+	// A new counter expires along with its room.
+	if seq == delta {
+		ttl, err := redis.Int64(c.Do("PTTL", fmt.Sprintf(r.cfg.PrefixRoom, roomID)))
+		if err != nil {
+			return 0, err
+		}
+		if ttl > 0 {
+			c.Do("PEXPIRE", key, ttl)
+		}
+	}
+	return seq, nil
+}
+
+// rolesKey returns the key of the hash holding the session roles of a room.
+func (r *Redis) rolesKey(roomID string) string {
+	return fmt.Sprintf(r.cfg.PrefixSession, roomID) + ":ROLES"
+}
+
 // AddSession adds a sessionID room to the store.
-func (r *Redis) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (r *Redis) AddSession(sessID, handle, role, roomID string, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
 	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
 	c.Send("HMSET", key, sessID, handle)
-	c.Send("EXPIRE", key, ttl.Seconds)
+	c.Send("EXPIRE", key, int(ttl.Seconds()))
+	c.Send("HMSET", r.rolesKey(roomID), sessID, role)
+	c.Send("EXPIRE", r.rolesKey(roomID), int(ttl.Seconds()))
 	return c.Flush()
 }
 
@@ -178,9 +288,15 @@ func (r *Redis) GetSession(sessID, roomID string) (store.Sess, error) {
 		return store.Sess{}, nil
 	}
 
+	role, err := redis.String(c.Do("HGET", r.rolesKey(roomID), sessID))
+	if err != nil && err != redis.ErrNil {
+		return store.Sess{}, err
+	}
+
 	return store.Sess{
 		ID:     sessID,
 		Handle: h,
+		Role:   role,
 	}, nil
 }
 
@@ -189,8 +305,9 @@ func (r *Redis) RemoveSession(sessID, roomID string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("HDEL", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID))
-	return err
+	c.Send("HDEL", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID)
+	c.Send("HDEL", r.rolesKey(roomID), sessID)
+	return c.Flush()
 }
 
 // ClearSessions deletes all the sessions in a room.
@@ -198,7 +315,7 @@ func (r *Redis) ClearSessions(roomID string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixSession, roomID)))
+	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixSession, roomID), r.rolesKey(roomID)))
 	return err
 }
 
@@ -224,3 +341,220 @@ func (r *Redis) Delete(key string) error {
 	_, err := c.Do("DEL", key)
 	return err
 }
+
+// Histories and mailboxes are sorted sets scored by the expiry of their
+// entries in microseconds, or +inf for the ones that don't expire. Members
+// are prefixed with the time they were added, which keeps the entries of the
+// same expiry in order and the same payloads apart.
+const stampLen = 16
+
+// micros returns a time in microseconds, which a score holds exactly.
+func micros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// addEntry adds a payload to a history or mailbox, dropping the expired
+// entries and keeping at most max entries.
+func (r *Redis) addEntry(key string, payload []byte, max int, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	now := time.Now()
+	var score interface{} = "+inf"
+	if ttl > 0 {
+		score = micros(now.Add(ttl))
+	}
+	member := append([]byte(fmt.Sprintf("%016x", micros(now))), payload...)
+
+	c.Send("MULTI")
+	c.Send("ZREMRANGEBYSCORE", key, "-inf", micros(now))
+	c.Send("ZADD", key, score, member)
+	if max > 0 {
+		c.Send("ZREMRANGEBYRANK", key, 0, -max-1)
+	}
+	if ttl > 0 {
+		c.Send("PEXPIRE", key, int64(ttl/time.Millisecond))
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// entryPayloads strips the members of a history or mailbox of their prefix.
+func entryPayloads(members [][]byte) [][]byte {
+	out := make([][]byte, 0, len(members))
+	for _, m := range members {
+		if len(m) >= stampLen {
+			out = append(out, m[stampLen:])
+		}
+	}
+	return out
+}
+
+// findEntry returns the member of a history holding a payload and its
+// score, or a nil member if there's none.
+func findEntry(c redis.Conn, key string, payload []byte) ([]byte, []byte, error) {
+	res, err := redis.ByteSlices(c.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	if err != nil && err != redis.ErrNil {
+		return nil, nil, err
+	}
+	for i := 0; i+1 < len(res); i += 2 {
+		if m := res[i]; len(m) >= stampLen && bytes.Equal(m[stampLen:], payload) {
+			return m, res[i+1], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// AddHistory appends a payload to a room's history, keeping at most max entries.
+func (r *Redis) AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error {
+	return r.addEntry(fmt.Sprintf(r.cfg.PrefixHistory, roomID), payload, max, ttl)
+}
+
+// GetHistory returns the live history payloads of a room, oldest first.
+func (r *Redis) GetHistory(roomID string) ([][]byte, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixHistory, roomID)
+	res, err := redis.ByteSlices(c.Do("ZRANGEBYSCORE", key, fmt.Sprintf("(%d", micros(time.Now())), "+inf"))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	return entryPayloads(res), nil
+}
+
+// ReplaceHistory replaces a payload of a room's history, keeping its expiry
+// and position.
+func (r *Redis) ReplaceHistory(roomID string, old, new []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixHistory, roomID)
+	m, score, err := findEntry(c, key, old)
+	if err != nil || m == nil {
+		return err
+	}
+	c.Send("MULTI")
+	c.Send("ZREM", key, m)
+	c.Send("ZADD", key, score, append(m[:stampLen:stampLen], new...))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// DeleteHistory removes a payload from a room's history.
+func (r *Redis) DeleteHistory(roomID string, payload []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixHistory, roomID)
+	m, _, err := findEntry(c, key, payload)
+	if err != nil || m == nil {
+		return err
+	}
+	_, err = c.Do("ZREM", key, m)
+	return err
+}
+
+// AddMail queues a payload for an offline user of a room, keeping at most max
+// payloads for the user.
+func (r *Redis) AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error {
+	return r.addEntry(fmt.Sprintf(r.cfg.PrefixMail, roomID, handle), payload, max, ttl)
+}
+
+// TakeMail returns the live payloads queued for a user of a room, oldest
+// first, and removes them.
+func (r *Redis) TakeMail(roomID, handle string) ([][]byte, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixMail, roomID, handle)
+	c.Send("MULTI")
+	c.Send("ZRANGEBYSCORE", key, fmt.Sprintf("(%d", micros(time.Now())), "+inf")
+	c.Send("DEL", key)
+	res, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	out, err := redis.ByteSlices(res[0], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	return entryPayloads(out), nil
+}
+
+// AddToken stores an autologin token of a user of a room, and adds its key
+// to the user's set of tokens.
+func (r *Redis) AddToken(roomID, token, handle string, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key, set := fmt.Sprintf(r.cfg.PrefixToken, roomID, token), r.userTokensKey(roomID, handle)
+	c.Send("MULTI")
+	c.Send("SET", key, handle, "PX", int64(ttl/time.Millisecond))
+	c.Send("SADD", set, key)
+	c.Send("PEXPIRE", set, int64(ttl/time.Millisecond))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// userTokensKey returns the key of the set of the token keys of a user of a
+// room. The tokens themselves don't contain colons.
+func (r *Redis) userTokensKey(roomID, handle string) string {
+	return fmt.Sprintf(r.cfg.PrefixToken, roomID, "USER:"+handle)
+}
+
+// TakeToken returns the user of a live autologin token of a room and removes
+// the token.
+func (r *Redis) TakeToken(roomID, token string) (string, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixToken, roomID, token)
+	c.Send("MULTI")
+	c.Send("GET", key)
+	c.Send("DEL", key)
+	res, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	handle, err := redis.String(res[0], nil)
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.Do("SREM", r.userTokensKey(roomID, handle), key); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+// RevokeTokens removes the autologin tokens of a user of a room.
+func (r *Redis) RevokeTokens(roomID, handle string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	set := r.userTokensKey(roomID, handle)
+	keys, err := redis.Strings(c.Do("SMEMBERS", set))
+	if err != nil {
+		return err
+	}
+	args := redis.Args{}.Add(set).AddFlat(keys)
+	_, err = c.Do("DEL", args...)
+	return err
+}
+
+// ClearHistory deletes the history of a room.
+func (r *Redis) ClearHistory(roomID string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("DEL", fmt.Sprintf(r.cfg.PrefixHistory, roomID))
+	return err
+}
+
+// Close the connection pool.
+func (r *Redis) Close() error {
+	return r.pool.Close()
+}
@@ -10,18 +10,54 @@ type Store interface {
 	AddPredefinedRoom(room Room) error
 	AddRoom(r Room, ttl time.Duration) error
 	GetRoom(id string) (Room, error)
+	// UpdateRoom updates the properties of a room, keeping its sessions and
+	// expiry.
+	UpdateRoom(r Room) error
 	ExtendRoomTTL(id string, ttl time.Duration) error
 	RoomExists(id string) (bool, error)
 	RemoveRoom(id string) error
+	// AddSeq adds delta to the sequence counter of a room, shared by the
+	// instances serving it, and returns the new value. Every call returns
+	// a different value.
+	AddSeq(roomID string, delta uint64) (uint64, error)
 
-	AddSession(sessID, handle, roomID string, ttl time.Duration) error
+	AddSession(sessID, handle, role, roomID string, ttl time.Duration) error
 	GetSession(sessID, roomID string) (Sess, error)
 	RemoveSession(sessID, roomID string) error
 	ClearSessions(roomID string) error
 
+	AddHistory(roomID string, payload []byte, max int, ttl time.Duration) error
+	GetHistory(roomID string) ([][]byte, error)
+	ClearHistory(roomID string) error
+	// ReplaceHistory replaces a payload of a room's history, keeping its
+	// expiry. It's a no-op if the payload is not in the history.
+	ReplaceHistory(roomID string, old, new []byte) error
+	// DeleteHistory removes a payload from a room's history. It's a no-op
+	// if the payload is not in the history.
+	DeleteHistory(roomID string, payload []byte) error
+
+	// AddMail queues a payload for an offline user of a room, keeping at
+	// most max payloads for the user.
+	AddMail(roomID, handle string, payload []byte, max int, ttl time.Duration) error
+	// TakeMail returns the live payloads queued for a user of a room,
+	// oldest first, and removes them.
+	TakeMail(roomID, handle string) ([][]byte, error)
+
+	// AddToken stores an autologin token of a user of a room.
+	AddToken(roomID, token, handle string, ttl time.Duration) error
+	// TakeToken returns the user of a live autologin token of a room and
+	// removes the token, which can only be used once. The user is empty if
+	// the token is unknown or expired.
+	TakeToken(roomID, token string) (string, error)
+	// RevokeTokens removes the autologin tokens of a user of a room.
+	RevokeTokens(roomID, handle string) error
+
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
 	Delete(key string) error
+
+	// Close flushes the store and releases its resources.
+	Close() error
 }
 
 // Room represents the properties of a room in the store.
@@ -29,13 +65,22 @@ type Room struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
 	Password  []byte    `json:"password"`
+	OwnerKey  []byte    `json:"owner_key"`
 	CreatedAt time.Time `json:"created_at"`
+	// The room's messages are end-to-end encrypted.
+	Encrypted bool `json:"encrypted"`
+
+	// Topic of the room and its pinned messages, set by its moderators at
+	// runtime. Pins are encoded chat message payloads.
+	Topic string   `json:"topic"`
+	Pins  [][]byte `json:"pins"`
 }
 
 // Sess represents an authenticated peer session.
 type Sess struct {
 	ID     string `json:"id"`
 	Handle string `json:"name"`
+	Role   string `json:"role"`
 }
 
 // ErrRoomNotFound indicates that the requested room was not found.
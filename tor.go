@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/clementauger/tor-prebuilt/embedded"
@@ -104,8 +105,12 @@ type torServer struct {
 	Handler http.Handler
 	// PrivateKey path to a pem encoded ed25519 private key
 	PrivateKey ed25519.PrivateKey
-	tor        *tor.Tor
-	onion      *tor.OnionService
+
+	// Tor process, onion service and its HTTP servers, to shut them down.
+	mu      sync.Mutex
+	tor     *tor.Tor
+	onion   *tor.OnionService
+	servers []*http.Server
 
 	TLSConfig    *tls.Config
 	TLSNextProto map[string]func(*http.Server, *tls.Conn, http.Handler)
@@ -132,7 +137,9 @@ func (ts *torServer) Serve(ln net.Listener) error {
 	if err != nil {
 		return fmt.Errorf("unable to start Tor: %v", err)
 	}
+	ts.mu.Lock()
 	ts.tor = t
+	ts.mu.Unlock()
 	// defer t.Close()
 
 	// Wait at most a few minutes to publish the service
@@ -148,33 +155,70 @@ func (ts *torServer) Serve(ln net.Listener) error {
 	if err != nil {
 		return fmt.Errorf("unable to create onion service: %v", err)
 	}
+	ts.mu.Lock()
 	ts.onion = onion
+	ts.mu.Unlock()
 
-	errc := make(chan error)
+	errc := make(chan error, 2)
 	if ts.TLSConfig != nil {
-		x := http.Server{
+		x := &http.Server{
 			Handler:      ts.Handler,
 			TLSConfig:    ts.TLSConfig,
 			TLSNextProto: ts.TLSNextProto,
 		}
+		ts.addServer(x)
 		go func() {
-			errc <- x.ServeTLS(ts.onion, "", "")
+			errc <- x.ServeTLS(onion, "", "")
 		}()
 	}
 
+	x := &http.Server{Handler: ts.Handler}
+	ts.addServer(x)
 	go func() {
-		errc <- http.Serve(ts.onion, ts.Handler)
+		errc <- x.Serve(onion)
 	}()
 	return <-errc
 }
+
+func (ts *torServer) addServer(s *http.Server) {
+	ts.mu.Lock()
+	ts.servers = append(ts.servers, s)
+	ts.mu.Unlock()
+}
+
+// Shutdown gracefully shuts down the HTTP servers of the onion service, then
+// stops Tor, which removes the service.
+func (ts *torServer) Shutdown(ctx context.Context) error {
+	ts.mu.Lock()
+	servers, t := ts.servers, ts.tor
+	ts.mu.Unlock()
+
+	var err error
+	for _, s := range servers {
+		if e := s.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if t != nil {
+		if e := t.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (ts *torServer) Close() error {
-	if ts.onion != nil {
-		if err := ts.onion.Close(); err != nil {
+	ts.mu.Lock()
+	t, onion := ts.tor, ts.onion
+	ts.mu.Unlock()
+
+	if onion != nil {
+		if err := onion.Close(); err != nil {
 			return err
 		}
 	}
-	if ts.tor != nil {
-		if err := ts.tor.Close(); err != nil {
+	if t != nil {
+		if err := t.Close(); err != nil {
 			return err
 		}
 	}